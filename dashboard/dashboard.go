@@ -1,5 +1,9 @@
 package dashboard
 
+// pollIntervalPlaceholder is replaced by the snapshot interval in milliseconds
+// when the page is served.
+const pollIntervalPlaceholder = "__POLL_INTERVAL_MS__"
+
 // HTML content as a raw string
 const HtmlContent = `
 <!DOCTYPE html>
@@ -173,7 +177,7 @@ const HtmlContent = `
                     console.error('An error occurred:', error);
                     clearInterval(intervalId); // Stop the interval if an error occurs
                 }
-            }, 1000);
+            }, __POLL_INTERVAL_MS__);
         </script>
     </div>
 </body>
@@ -0,0 +1,91 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/accelira/accelira/metrics"
+	"github.com/accelira/accelira/metricsprocessor"
+)
+
+// Dashboard serves the live dashboard. Instead of reading the aggregates on
+// every poll, it takes a snapshot of them at a fixed interval, so the cost of
+// the dashboard doesn't grow with the request rate.
+type Dashboard struct {
+	interval time.Duration
+
+	mutex        sync.RWMutex
+	snapshot     map[string]map[string]interface{}
+	lastSnapshot time.Time
+}
+
+// New creates a dashboard that refreshes its snapshot every interval.
+func New(interval time.Duration) *Dashboard {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &Dashboard{interval: interval, snapshot: make(map[string]map[string]interface{})}
+}
+
+// HandleMetric is called for every collected metric on the goroutine that
+// aggregates them, so the aggregates can be read safely here. A new snapshot
+// is only taken once the interval has passed.
+func (d *Dashboard) HandleMetric(metric metrics.Metrics) {
+	if time.Since(d.lastSnapshot) < d.interval {
+		return
+	}
+	d.takeSnapshot()
+}
+
+// HandleSummary takes a final snapshot once the run is over.
+func (d *Dashboard) HandleSummary(metricsMap *map[string]*metrics.EndpointMetricsAggregated) error {
+	d.takeSnapshot()
+	return nil
+}
+
+func (d *Dashboard) takeSnapshot() {
+	snapshot := make(map[string]map[string]interface{})
+	for key, aggregated := range metricsprocessor.MetricsMap {
+		if aggregated.Type != metrics.HTTPRequest || aggregated.ResponseTimesTDigest == nil {
+			continue
+		}
+		snapshot[key] = map[string]interface{}{
+			"requests":         aggregated.TotalRequests,
+			"errors":           aggregated.TotalErrors,
+			"p50":              aggregated.ResponseTimesTDigest.Quantile(0.5),
+			"p90":              aggregated.ResponseTimesTDigest.Quantile(0.9),
+			"realtimeResponse": aggregated.ResponseTimesTDigest.Quantile(0.95),
+		}
+	}
+
+	d.mutex.Lock()
+	d.snapshot = snapshot
+	d.lastSnapshot = time.Now()
+	d.mutex.Unlock()
+}
+
+// ListenAndServe serves the dashboard page at / and the latest snapshot at
+// /metrics. The page polls at the snapshot interval.
+func (d *Dashboard) ListenAndServe(addr string) error {
+	page := strings.Replace(HtmlContent, pollIntervalPlaceholder, strconv.FormatInt(d.interval.Milliseconds(), 10), 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(page))
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		d.mutex.RLock()
+		defer d.mutex.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(d.snapshot); err != nil {
+			http.Error(w, "Failed to encode metrics", http.StatusInternalServerError)
+		}
+	})
+	return http.ListenAndServe(addr, mux)
+}
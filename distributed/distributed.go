@@ -0,0 +1,267 @@
+// File: distributed/distributed.go
+package distributed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/accelira/accelira/metrics"
+	"github.com/accelira/accelira/metricsprocessor"
+	"github.com/accelira/accelira/moduleloader"
+)
+
+// Job is sent by the coordinator to a worker: the bundled script, the
+// worker's share of the configuration and how often to report back.
+type Job struct {
+	Script           string
+	Config           moduleloader.Config
+	SnapshotInterval time.Duration
+}
+
+// Split divides the run-wide totals and rates of the job's configuration
+// between the given number of workers, so together they run the configured
+// load rather than each running all of it. Settings that apply per VU are
+// left as they are. A positive total too small to give every worker a share
+// is an error, since 0 would mean no limit.
+func (j Job) Split(workers int) ([]Job, error) {
+	jobs := make([]Job, workers)
+	for i := range jobs {
+		jobs[i] = j
+		config := &jobs[i].Config
+
+		for _, total := range []struct {
+			name  string
+			value *int
+		}{
+			{"VUs", &config.ConcurrentUsers},
+			{"ramp-up rate", &config.RampUpRate},
+			{"shared iterations", &config.SharedIterations},
+			{"max requests", &config.MaxRequests},
+			{"max concurrent", &config.MaxConcurrent},
+		} {
+			if *total.value > 0 && *total.value < workers {
+				return nil, fmt.Errorf("%s of %d can't be split between %d workers", total.name, *total.value, workers)
+			}
+			*total.value = share(*total.value, i, workers)
+		}
+
+		config.RateStages = make([]moduleloader.RateStage, len(j.Config.RateStages))
+		for k, stage := range j.Config.RateStages {
+			stage.Target /= float64(workers)
+			config.RateStages[k] = stage
+		}
+	}
+	return jobs, nil
+}
+
+// share returns the part of total the worker at index runs; the remainder of
+// an uneven split goes to the first workers.
+func share(total, index, workers int) int {
+	part := total / workers
+	if index < total%workers {
+		part++
+	}
+	return part
+}
+
+// Result is a snapshot of a worker's aggregated metrics so far. Workers send
+// one every SnapshotInterval while the job runs and a final one once it
+// completes; each replaces the previous one from the same worker.
+type Result struct {
+	Metrics map[string]*metrics.EndpointMetricsAggregated
+	Error   string
+	Final   bool
+}
+
+// encodedResult is a Result whose metrics are already encoded, so a snapshot
+// can be taken on the aggregating goroutine and sent from another.
+type encodedResult struct {
+	Metrics json.RawMessage
+	Error   string `json:",omitempty"`
+	Final   bool
+}
+
+// Coordinator hands jobs to a fixed number of workers and collects their
+// results.
+type Coordinator struct {
+	listener net.Listener
+	workers  int
+}
+
+// NewCoordinator starts listening for workers on the given address.
+func NewCoordinator(address string, workers int) (*Coordinator, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", address, err)
+	}
+	return &Coordinator{listener: listener, workers: workers}, nil
+}
+
+// Addr returns the address the coordinator is listening on.
+func (c *Coordinator) Addr() net.Addr {
+	return c.listener.Addr()
+}
+
+// Run waits until all workers have connected, starts one of the jobs on each
+// of them at once and calls handleResult for each snapshot as it arrives. A
+// worker that disconnects before its final result is reported in the returned
+// error; the last snapshot received from it has already been handled.
+func (c *Coordinator) Run(jobs []Job, handleResult func(worker string, result Result)) error {
+	defer c.listener.Close()
+
+	conns := make([]net.Conn, 0, c.workers)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for len(conns) < c.workers {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return fmt.Errorf("error accepting worker: %w", err)
+		}
+		conns = append(conns, conn)
+		fmt.Printf("Worker %s connected (%d/%d)\n", conn.RemoteAddr(), len(conns), c.workers)
+	}
+
+	var waitGroup sync.WaitGroup
+	errs := make(chan error, len(conns))
+
+	for i, conn := range conns {
+		waitGroup.Add(1)
+		go func(conn net.Conn, job Job) {
+			defer waitGroup.Done()
+
+			if err := json.NewEncoder(conn).Encode(job); err != nil {
+				errs <- fmt.Errorf("error sending job to %s: %w", conn.RemoteAddr(), err)
+				return
+			}
+
+			decoder := json.NewDecoder(conn)
+			for {
+				var result Result
+				if err := decoder.Decode(&result); err != nil {
+					errs <- fmt.Errorf("worker %s disconnected before finishing: %w", conn.RemoteAddr(), err)
+					return
+				}
+				handleResult(conn.RemoteAddr().String(), result)
+				if result.Final {
+					return
+				}
+			}
+		}(conn, jobs[i])
+	}
+
+	waitGroup.Wait()
+	close(errs)
+
+	var workerErrs []error
+	for err := range errs {
+		workerErrs = append(workerErrs, err)
+	}
+	return errors.Join(workerErrs...)
+}
+
+// RunWorker connects to a coordinator and runs the job it receives with
+// runJob, passing the output that streams snapshots of the aggregated metrics
+// back while the job runs. The final metrics are sent once runJob returns.
+func RunWorker(coordinatorAddress string, runJob func(job Job, stream *Stream) error) error {
+	conn, err := net.Dial("tcp", coordinatorAddress)
+	if err != nil {
+		return fmt.Errorf("error connecting to coordinator %s: %w", coordinatorAddress, err)
+	}
+	defer conn.Close()
+
+	var job Job
+	if err := json.NewDecoder(conn).Decode(&job); err != nil {
+		return fmt.Errorf("error receiving job: %w", err)
+	}
+
+	encoder := json.NewEncoder(conn)
+	stream := newStream(encoder, job.SnapshotInterval)
+
+	final := encodedResult{Final: true}
+	if err := runJob(job, stream); err != nil {
+		final.Error = err.Error()
+	}
+	if err := stream.close(); err != nil {
+		return fmt.Errorf("error sending snapshot: %w", err)
+	}
+
+	if final.Metrics, err = json.Marshal(metricsprocessor.MetricsMap); err != nil {
+		return fmt.Errorf("error encoding result: %w", err)
+	}
+	if err := encoder.Encode(final); err != nil {
+		return fmt.Errorf("error sending result: %w", err)
+	}
+	return nil
+}
+
+// Stream is the output a worker runs its job with. HandleMetric is called for
+// every collected metric on the goroutine that aggregates them, so the
+// aggregates can be encoded safely there; a separate goroutine sends the
+// latest snapshot, so a slow link to the coordinator never holds up
+// aggregation.
+type Stream struct {
+	interval     time.Duration
+	lastSnapshot time.Time
+	pending      chan json.RawMessage
+	done         chan error
+}
+
+func newStream(encoder *json.Encoder, interval time.Duration) *Stream {
+	s := &Stream{
+		interval:     interval,
+		lastSnapshot: time.Now(),
+		pending:      make(chan json.RawMessage, 1),
+		done:         make(chan error, 1),
+	}
+
+	go func() {
+		var err error
+		for snapshot := range s.pending {
+			if err == nil {
+				err = encoder.Encode(encodedResult{Metrics: snapshot})
+			}
+		}
+		s.done <- err
+	}()
+	return s
+}
+
+// HandleMetric takes a snapshot once the interval has passed. A snapshot that
+// hasn't been sent yet is replaced by the newer one.
+func (s *Stream) HandleMetric(metric metrics.Metrics) {
+	if s.interval <= 0 || time.Since(s.lastSnapshot) < s.interval {
+		return
+	}
+	s.lastSnapshot = time.Now()
+
+	snapshot, err := json.Marshal(metricsprocessor.MetricsMap)
+	if err != nil {
+		fmt.Println("Error encoding snapshot:", err)
+		return
+	}
+
+	select {
+	case <-s.pending:
+	default:
+	}
+	s.pending <- snapshot
+}
+
+// HandleSummary does nothing; RunWorker sends the final metrics itself.
+func (s *Stream) HandleSummary(metricsMap *map[string]*metrics.EndpointMetricsAggregated) error {
+	return nil
+}
+
+// close waits until the pending snapshot has been sent.
+func (s *Stream) close() error {
+	close(s.pending)
+	return <-s.done
+}
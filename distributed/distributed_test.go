@@ -0,0 +1,56 @@
+package distributed
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/accelira/accelira/moduleloader"
+)
+
+// Run-wide totals add up to the configured load across workers, with the
+// remainder going to the first workers
+func TestSplitDividesRunWideTotals(t *testing.T) {
+	job := Job{Config: moduleloader.Config{
+		ConcurrentUsers:  10,
+		SharedIterations: 1000,
+		MaxRequests:      7,
+		VURate:           2,
+		RateStages:       []moduleloader.RateStage{{Target: 300}},
+	}}
+
+	jobs, err := job.Split(3)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	vus, iterations, requests := 0, 0, 0
+	for _, split := range jobs {
+		vus += split.Config.ConcurrentUsers
+		iterations += split.Config.SharedIterations
+		requests += split.Config.MaxRequests
+		if split.Config.VURate != 2 {
+			t.Errorf("expected the per-VU rate to be kept, got %v", split.Config.VURate)
+		}
+		if split.Config.RateStages[0].Target != 100 {
+			t.Errorf("expected an arrival rate of 100 per worker, got %v", split.Config.RateStages[0].Target)
+		}
+	}
+	if vus != 10 || iterations != 1000 || requests != 7 {
+		t.Fatalf("expected totals of 10 VUs, 1000 iterations and 7 requests, got %d, %d and %d", vus, iterations, requests)
+	}
+	if jobs[0].Config.ConcurrentUsers != 4 || jobs[2].Config.ConcurrentUsers != 3 {
+		t.Fatalf("expected the remainder to go to the first worker, got %d and %d", jobs[0].Config.ConcurrentUsers, jobs[2].Config.ConcurrentUsers)
+	}
+	if job.Config.RateStages[0].Target != 300 {
+		t.Fatalf("expected the original job to be left alone, got a rate of %v", job.Config.RateStages[0].Target)
+	}
+}
+
+// A total smaller than the number of workers would leave a worker without
+// a limit
+func TestSplitRejectsTotalsSmallerThanWorkers(t *testing.T) {
+	job := Job{Config: moduleloader.Config{ConcurrentUsers: 4, SharedIterations: 2}}
+	if _, err := job.Split(3); err == nil || !strings.Contains(err.Error(), "shared iterations") {
+		t.Fatalf("expected an error about shared iterations, got %v", err)
+	}
+}
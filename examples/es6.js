@@ -19,8 +19,8 @@ export default function () {
         // console.log('Received response', getResponse1);
         const assertions = {
             'is status 200': (response) => {
-                // console.log('Checking response status', response.StatusCode);
-                return response.StatusCode === 200;
+                // console.log('Checking response status', response.status);
+                return response.status === 200;
             },
         };
 
@@ -0,0 +1,241 @@
+package httpclient
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/accelira/accelira/metrics"
+)
+
+// credentials are the user and password a client authenticates with.
+type credentials struct {
+	user     string
+	password string
+	digest   bool // answer Digest challenges instead of sending Basic auth
+
+	challenge *digestChallenge // last Digest challenge, reused until it is rejected
+	count     int              // requests sent with the challenge's nonce
+}
+
+// digestChallenge holds the parameters of a WWW-Authenticate: Digest header.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+}
+
+// SetBasicAuth sends every request of the client with Basic credentials.
+func (hc *HTTPClient) SetBasicAuth(user, password string) {
+	hc.authMutex.Lock()
+	defer hc.authMutex.Unlock()
+	hc.auth = &credentials{user: user, password: password}
+}
+
+// SetDigestAuth makes the client answer Digest challenges with the given
+// credentials. The first request to a protected resource gets a 401 and is
+// sent again with the computed response; later requests reuse the challenge
+// until the server rejects it.
+func (hc *HTTPClient) SetDigestAuth(user, password string) {
+	hc.authMutex.Lock()
+	defer hc.authMutex.Unlock()
+	hc.auth = &credentials{user: user, password: password, digest: true}
+}
+
+// usesDigestAuth reports whether requests may have to be sent twice to answer
+// a Digest challenge.
+func (hc *HTTPClient) usesDigestAuth() bool {
+	hc.authMutex.Lock()
+	defer hc.authMutex.Unlock()
+	return hc.auth != nil && hc.auth.digest
+}
+
+// doAuthenticated sends the request with the client's credentials, answering
+// a Digest challenge by sending it again. newBody returns the body of each
+// attempt. Requests setting their own Authorization header are sent as is.
+func (hc *HTTPClient) doAuthenticated(url, method string, newBody func() io.Reader, headers http.Header, events *traceLog, tags map[string]string, metricsChannel chan<- metrics.Metrics) (HttpResponse, error) {
+	if headers.Get("Authorization") != "" {
+		return hc.doRequest(url, method, newBody(), headers, events, tags, metricsChannel)
+	}
+
+	resp, err := hc.doRequest(url, method, newBody(), hc.authorize(url, method, headers), events, tags, metricsChannel)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !hc.usesDigestAuth() {
+		return resp, err
+	}
+
+	challenge := parseDigestChallenge(resp.Headers.Values("WWW-Authenticate"))
+	if challenge == nil {
+		return resp, err
+	}
+	hc.authMutex.Lock()
+	hc.auth.challenge = challenge
+	hc.auth.count = 0
+	hc.authMutex.Unlock()
+
+	return hc.doRequest(url, method, newBody(), hc.authorize(url, method, headers), events, tags, metricsChannel)
+}
+
+// authorize returns the headers with an Authorization header for the client's
+// credentials added, or the headers unchanged when there is nothing to send.
+func (hc *HTTPClient) authorize(url, method string, headers http.Header) http.Header {
+	hc.authMutex.Lock()
+	defer hc.authMutex.Unlock()
+
+	auth := hc.auth
+	if auth == nil || (auth.digest && auth.challenge == nil) {
+		return headers
+	}
+
+	var authorization string
+	if auth.digest {
+		auth.count++
+		authorization = auth.challenge.authorization(auth.user, auth.password, method, requestURI(url), auth.count)
+	} else {
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(auth.user, auth.password)
+		authorization = req.Header.Get("Authorization")
+	}
+
+	authorized := headers.Clone()
+	if authorized == nil {
+		authorized = make(http.Header)
+	}
+	authorized.Set("Authorization", authorization)
+	return authorized
+}
+
+// parseDigestChallenge returns the first Digest challenge among the
+// WWW-Authenticate values, or nil if there is none.
+func parseDigestChallenge(values []string) *digestChallenge {
+	for _, value := range values {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(value), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+
+		fields := parseAuthParams(params)
+		challenge := &digestChallenge{
+			realm:     fields["realm"],
+			nonce:     fields["nonce"],
+			opaque:    fields["opaque"],
+			algorithm: fields["algorithm"],
+		}
+		// Prefer plain auth when the server also offers auth-int.
+		for _, qop := range strings.Split(fields["qop"], ",") {
+			if strings.TrimSpace(qop) == "auth" {
+				challenge.qop = "auth"
+			}
+		}
+		if challenge.nonce == "" {
+			return nil
+		}
+		return challenge
+	}
+	return nil
+}
+
+// parseAuthParams parses comma-separated name=value pairs whose values may be
+// quoted, e.g. realm="api", qop="auth,auth-int", algorithm=MD5.
+func parseAuthParams(params string) map[string]string {
+	fields := make(map[string]string)
+	for params != "" {
+		var name string
+		name, params, _ = strings.Cut(params, "=")
+		name = strings.ToLower(strings.TrimSpace(strings.TrimLeft(name, ", ")))
+
+		var value string
+		params = strings.TrimSpace(params)
+		if strings.HasPrefix(params, `"`) {
+			end := strings.Index(params[1:], `"`)
+			if end < 0 {
+				end = len(params) - 1
+			}
+			value, params = params[1:end+1], params[end+1:]
+			params = strings.TrimPrefix(params, `"`)
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		params = strings.TrimLeft(params, ", ")
+		if name != "" {
+			fields[name] = strings.TrimSpace(value)
+		}
+	}
+	return fields
+}
+
+// authorization computes the Authorization header answering the challenge
+// (RFC 7616), for MD5 and SHA-256 and their -sess variants.
+func (c *digestChallenge) authorization(user, password, method, uri string, count int) string {
+	algorithm := strings.ToUpper(c.algorithm)
+	newHash := md5.New
+	if strings.HasPrefix(algorithm, "SHA-256") {
+		newHash = sha256.New
+	}
+	digest := func(parts ...string) string {
+		return hashHex(newHash(), strings.Join(parts, ":"))
+	}
+
+	nc := fmt.Sprintf("%08x", count)
+	cnonce := newClientNonce()
+
+	ha1 := digest(user, c.realm, password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = digest(ha1, c.nonce, cnonce)
+	}
+	ha2 := digest(method, uri)
+
+	var response string
+	if c.qop != "" {
+		response = digest(ha1, c.nonce, nc, cnonce, c.qop, ha2)
+	} else {
+		response = digest(ha1, c.nonce, ha2)
+	}
+
+	fields := []string{
+		fmt.Sprintf(`username="%s"`, user),
+		fmt.Sprintf(`realm="%s"`, c.realm),
+		fmt.Sprintf(`nonce="%s"`, c.nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+		fmt.Sprintf(`response="%s"`, response),
+	}
+	if c.algorithm != "" {
+		fields = append(fields, "algorithm="+c.algorithm)
+	}
+	if c.opaque != "" {
+		fields = append(fields, fmt.Sprintf(`opaque="%s"`, c.opaque))
+	}
+	if c.qop != "" {
+		fields = append(fields, "qop="+c.qop, "nc="+nc, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	return "Digest " + strings.Join(fields, ", ")
+}
+
+func hashHex(h hash.Hash, s string) string {
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newClientNonce returns a random cnonce.
+func newClientNonce() string {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// requestURI returns the path and query the Digest response is computed over.
+func requestURI(url string) string {
+	parsed, err := neturl.Parse(url)
+	if err != nil {
+		return url
+	}
+	return parsed.RequestURI()
+}
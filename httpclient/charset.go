@@ -0,0 +1,55 @@
+package httpclient
+
+import (
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// decodeBody returns a response body as UTF-8 text, transcoding it from the
+// charset declared in its Content-Type. Bodies of binary types come back
+// empty; they're only available as bytes, since turning them into a string
+// would just produce mojibake. A body without a Content-Type is taken as text.
+func decodeBody(data []byte, contentType string) string {
+	if contentType == "" {
+		return string(data)
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return string(data)
+	}
+	if !isTextMediaType(mediaType) {
+		return ""
+	}
+
+	charset := strings.ToLower(params["charset"])
+	if charset == "" || charset == "utf-8" || charset == "utf8" {
+		return string(data)
+	}
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		// An unknown charset is passed through rather than failing the request.
+		return string(data)
+	}
+	decoded, err := encoding.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(decoded)
+}
+
+// isTextMediaType reports whether a media type is text, including the
+// structured text formats APIs use such as JSON and XML.
+func isTextMediaType(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/ecmascript",
+		"application/x-www-form-urlencoded", "application/graphql", "application/yaml", "application/x-yaml",
+		"application/x-ndjson", "application/csv", "image/svg+xml":
+		return true
+	}
+	return false
+}
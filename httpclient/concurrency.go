@@ -0,0 +1,53 @@
+package httpclient
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	// concurrencySlots holds a token per request in flight across all
+	// clients, like a shared connection pool; nil for no limit.
+	concurrencySlots      chan struct{}
+	concurrencySlotsMutex sync.RWMutex
+)
+
+// SetMaxConcurrent limits the requests in flight across all clients to max,
+// 0 for no limit. Requests over the limit wait for one to finish.
+func SetMaxConcurrent(max int) {
+	concurrencySlotsMutex.Lock()
+	defer concurrencySlotsMutex.Unlock()
+	if max > 0 {
+		concurrencySlots = make(chan struct{}, max)
+	} else {
+		concurrencySlots = nil
+	}
+}
+
+// ConcurrencyLimitReached reports whether as many requests as allowed are in
+// flight, so a new one would have to wait.
+func ConcurrencyLimitReached() bool {
+	slots := currentConcurrencySlots()
+	return slots != nil && len(slots) == cap(slots)
+}
+
+func currentConcurrencySlots() chan struct{} {
+	concurrencySlotsMutex.RLock()
+	defer concurrencySlotsMutex.RUnlock()
+	return concurrencySlots
+}
+
+// acquireConcurrencySlot waits until a request may be sent and returns the
+// function that frees its slot again, or an error if ctx is done first.
+func acquireConcurrencySlot(ctx context.Context) (release func(), err error) {
+	slots := currentConcurrencySlots()
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,88 @@
+package httpclient
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsCacheEntry holds the addresses a host resolved to.
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time // zero if the entry never expires
+}
+
+// dnsCache holds resolved hosts shared by all clients, like the resolver cache
+// of an operating system.
+var (
+	dnsCache       = make(map[string]dnsCacheEntry)
+	dnsCacheMutex  sync.Mutex
+	dnsCacheHits   int64
+	dnsCacheMisses int64
+)
+
+// DNSCacheStats returns how many lookups were answered from the DNS cache and
+// how many had to be resolved.
+func DNSCacheStats() (hits, misses int64) {
+	return atomic.LoadInt64(&dnsCacheHits), atomic.LoadInt64(&dnsCacheMisses)
+}
+
+// lookupCached returns the addresses of host, resolving them only when they
+// aren't cached or their ttl has passed. A ttl of 0 keeps them for the whole
+// run. Resolving under ctx reports the lookup to the request's trace, so only
+// misses add DNS latency.
+func lookupCached(ctx context.Context, host string, ttl time.Duration) ([]net.IPAddr, error) {
+	now := time.Now()
+	dnsCacheMutex.Lock()
+	entry, ok := dnsCache[host]
+	dnsCacheMutex.Unlock()
+	if ok && (entry.expires.IsZero() || now.Before(entry.expires)) {
+		atomic.AddInt64(&dnsCacheHits, 1)
+		return entry.addrs, nil
+	}
+
+	atomic.AddInt64(&dnsCacheMisses, 1)
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	entry = dnsCacheEntry{addrs: addrs}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+	dnsCacheMutex.Lock()
+	dnsCache[host] = entry
+	dnsCacheMutex.Unlock()
+	return addrs, nil
+}
+
+// dialCached dials addr, resolving its host through the DNS cache and trying
+// each of its addresses in turn. Addresses that are already IPs are dialed
+// directly.
+func dialCached(ctx context.Context, dialer *net.Dialer, network, addr string, ttl time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := lookupCached(ctx, host, ttl)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, ip := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.DNSError{Err: "no addresses found", Name: host}
+	}
+	return nil, firstErr
+}
@@ -2,42 +2,150 @@ package httpclient
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptrace"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/accelira/accelira/metrics"
 )
 
+var (
+	runContext      = context.Background()
+	runContextMutex sync.RWMutex
+)
+
+// SetRunContext sets the context every request is issued under. Cancelling it
+// aborts all in-flight requests, e.g. when the graceful stop period runs out.
+func SetRunContext(ctx context.Context) {
+	runContextMutex.Lock()
+	defer runContextMutex.Unlock()
+	runContext = ctx
+}
+
+// RunContext returns the context requests are issued under.
+func RunContext() context.Context {
+	runContextMutex.RLock()
+	defer runContextMutex.RUnlock()
+	return runContext
+}
+
+// requestsStarted counts the requests issued by all clients.
+var requestsStarted int64
+
+// RequestsStarted returns the number of requests issued so far, including any
+// refused because the request limit was reached.
+func RequestsStarted() int64 {
+	return atomic.LoadInt64(&requestsStarted)
+}
+
+// inFlightRequests holds an *int64 counter of in-flight requests per endpoint,
+// shared by every VU's client.
+var inFlightRequests sync.Map
+
+// endpointInFlight returns the in-flight counter for an endpoint.
+func endpointInFlight(method, url string) *int64 {
+	counter, _ := inFlightRequests.LoadOrStore(method+" "+url, new(int64))
+	return counter.(*int64)
+}
+
 type HTTPClient struct {
 	client     *http.Client
 	bufferPool sync.Pool
+	options    ClientOptions
+
+	validatorsMutex sync.Mutex
+	validators      map[string]cacheValidators // by URL, for conditional requests
+
+	authMutex sync.Mutex
+	auth      *credentials // set by SetBasicAuth or SetDigestAuth
+
+	randomMutex sync.Mutex
+	random      *rand.Rand // the client's own source for sampling decisions
+}
+
+// cacheValidators are the response headers used to revalidate a cached URL.
+type cacheValidators struct {
+	etag         string
+	lastModified string
 }
 
-func NewHTTPClient() *HTTPClient {
+// ClientOptions controls optional behaviour of the HTTP client.
+type ClientOptions struct {
+	TraceRequests       bool              // log the httptrace breakdown for sampled requests
+	TraceSampleRate     float64           // fraction of requests traced when TraceRequests is set
+	MaxRequests         int               // total requests allowed across all clients, 0 for no limit
+	ConditionalRequests bool              // revalidate seen URLs with If-None-Match/If-Modified-Since
+	HostResolve         map[string]string // "host:port" to the "ip:port" to connect to instead, like curl --resolve
+	NoKeepAlive         bool              // open a new connection for every request
+	MaxRetries          int               // retries of rate-limited responses, after their Retry-After delay
+	UserAgent           string            // User-Agent of every request, empty for DefaultUserAgent
+	ExpectedStatus      []StatusRange     // statuses counted as successful, empty for any
+	TraceHeaders        bool              // attach a generated X-Request-ID and traceparent to every request
+	DNSCache            bool              // resolve each host once and reuse its addresses, shared by all clients
+	DNSCacheTTL         time.Duration     // how long cached addresses are reused with DNSCache, 0 for the whole run
+	MaxRedirects        int               // redirects a request may follow, 0 for DefaultMaxRedirects, negative for none
+	NoTLSResumption     bool              // make a full TLS handshake on every new connection instead of resuming a session
+	MetricsSampleRate   float64           // fraction of requests whose latencies go into the digests, 0 for all
+	ConnectTimeout      time.Duration     // how long establishing a connection may take, 0 for DefaultConnectTimeout
+	Seed                int64             // seed of the sampling decisions, offset per client; 0 for a random seed
+}
+
+// DefaultUserAgent is sent unless a user agent is configured or a request sets
+// its own User-Agent header.
+const DefaultUserAgent = "Accelira perf testing tool/1.0"
+
+// DefaultConnectTimeout is how long establishing a connection may take when no
+// connect timeout is configured, the same as the timeout of the whole request.
+const DefaultConnectTimeout = 30 * time.Second
+
+// StatusConnectTimeout is the status of requests that timed out establishing
+// a connection, the code proxies use for an origin that can't be reached in
+// time. Requests that connected but timed out waiting for the response get
+// 408 Request Timeout.
+const StatusConnectTimeout = 522
+
+func NewHTTPClient(options ClientOptions) *HTTPClient {
+
+	connectTimeout := options.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
 
 	transport := &http.Transport{
+		DialContext:         resolvingDialContext(dialer, options),
 		MaxIdleConns:        100,
 		IdleConnTimeout:     10 * time.Second,
-		DisableKeepAlives:   false,
+		DisableKeepAlives:   options.NoKeepAlive,
 		MaxIdleConnsPerHost: 100,
 		TLSHandshakeTimeout: 10 * time.Second, // Timeout for TLS handshake
+		TLSClientConfig:     tlsConfig(options),
 		ForceAttemptHTTP2:   true,
 	}
 
 	client := &http.Client{
-		Transport: transport,
-		Timeout:   30 * time.Second,
+		Transport:     transport,
+		Timeout:       30 * time.Second,
+		CheckRedirect: checkRedirect(options.MaxRedirects),
 	}
 
 	return &HTTPClient{
-		client: client,
+		client:     client,
+		options:    options,
+		validators: make(map[string]cacheValidators),
+		random:     newClientRandom(options.Seed),
 		bufferPool: sync.Pool{
 			New: func() interface{} {
 				buf := make([]byte, 32*1024) // 32KB buffer
@@ -46,10 +154,54 @@ func NewHTTPClient() *HTTPClient {
 		},
 	}
 }
-func handleRequestError(err error, url, method string, duration time.Duration, metricsChannel chan<- metrics.Metrics) (HttpResponse, error) {
+
+// clientsCreated counts the clients created, giving each a distinct seed.
+var clientsCreated int64
+
+// newClientRandom returns the random source of a new client. Each client has
+// its own, so VUs don't contend on the global source; with a seed, clients
+// are seeded with it plus their number, like the VUs' Math.random.
+func newClientRandom(seed int64) *rand.Rand {
+	n := atomic.AddInt64(&clientsCreated, 1)
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed + n))
+}
+
+// sample reports whether a request falls within a sample rate. The lock is
+// only contended by the concurrent requests of one VU's batch.
+func (hc *HTTPClient) sample(rate float64) bool {
+	hc.randomMutex.Lock()
+	defer hc.randomMutex.Unlock()
+	return hc.random.Float64() < rate
+}
+
+// tlsConfig returns the TLS settings of a client. Like a browser, each client
+// resumes the TLS sessions of the servers it has talked to, unless
+// NoTLSResumption asks for a full handshake every time.
+func tlsConfig(options ClientOptions) *tls.Config {
+	if options.NoTLSResumption {
+		return &tls.Config{SessionTicketsDisabled: true}
+	}
+	return &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+}
+
+func handleRequestError(err error, url, method string, duration time.Duration, inFlight int, tags map[string]string, metricsChannel chan<- metrics.Metrics) (HttpResponse, error) {
 	var statusCode int
 	var body string
 
+	// Requests cut off by a hard stop are not the server's fault, so they are
+	// recorded as aborted rather than as errors.
+	if errors.Is(err, context.Canceled) {
+		metrics1 := collectMetricsWithLatencies(url, method, 0, 0, 0, 0, duration, 0, 0, 0, 0, 0, inFlight)
+		endpointMetrics := metrics1.EndpointMetricsMap[fmt.Sprintf("%s %s", method, url)]
+		endpointMetrics.Aborted = 1
+		endpointMetrics.Tags = tags
+		metrics.SendMetrics(metrics1, metricsChannel)
+		return HttpResponse{Body: "Request aborted", URL: url, Method: method, Duration: duration}, nil
+	}
+
 	switch e := err.(type) {
 	case *net.OpError:
 		if e.Op == "dial" && e.Err.Error() == "connection refused" {
@@ -72,53 +224,286 @@ func handleRequestError(err error, url, method string, duration time.Duration, m
 		statusCode = http.StatusInternalServerError
 	}
 
-	metrics1 := collectMetricsWithLatencies(url, method, 1, 0, 0, statusCode, duration, 0, 0, 0)
+	// A redirect loop is reported with the length of the chain, so it can be
+	// told apart from other failures in the report.
+	var redirectChain int
+	var redirectErr *TooManyRedirectsError
+	if errors.As(err, &redirectErr) {
+		body = fmt.Sprintf("Too many redirects: stopped after %d redirects (limit %d) before %s", redirectErr.Redirects, redirectErr.Limit, redirectErr.Location)
+		statusCode = http.StatusLoopDetected
+		redirectChain = redirectErr.Redirects
+	}
+
+	// A timeout while dialing means the server couldn't be reached, which is
+	// reported apart from a server that was reached but answered too slowly.
+	var connectTimeouts, responseTimeouts int
+	var opErr *net.OpError
+	var netErr net.Error
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		body = "Connect timed out: " + opErr.Error()
+		statusCode = StatusConnectTimeout
+		connectTimeouts = 1
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		responseTimeouts = 1
+	}
+
+	metrics1 := collectMetricsWithLatencies(url, method, 1, 0, 0, statusCode, duration, 0, 0, 0, 0, 0, inFlight)
+	endpointMetrics := metrics1.EndpointMetricsMap[fmt.Sprintf("%s %s", method, url)]
+	endpointMetrics.Tags = tags
+	endpointMetrics.RedirectChain = redirectChain
+	endpointMetrics.TransportErrors = 1
+	endpointMetrics.ConnectTimeouts = connectTimeouts
+	endpointMetrics.ResponseTimeouts = responseTimeouts
 	metrics.SendMetrics(metrics1, metricsChannel)
 
 	return HttpResponse{Body: body, StatusCode: statusCode, URL: url, Method: method, Duration: duration}, nil
 }
-func (hc *HTTPClient) DoRequest(url, method string, body io.Reader, metricsChannel chan<- metrics.Metrics) (HttpResponse, error) {
+
+// DoRequest sends a request and reports its metrics. Headers, if any, are set
+// after the defaults so they can override them.
+func (hc *HTTPClient) DoRequest(url, method string, body io.Reader, headers http.Header, metricsChannel chan<- metrics.Metrics) (HttpResponse, error) {
+	return hc.DoRequestWithOptions(url, method, body, headers, RequestOptions{}, metricsChannel)
+}
+
+// RequestOptions are optional settings of a single request.
+type RequestOptions struct {
+	Trace     bool              // record the httptrace events in HttpResponse.TraceEvents
+	Tags      map[string]string // attached to the metrics of the request
+	NoMetrics bool              // send the request without reporting its metrics
+	Compress  string            // Content-Encoding to compress the body with: "gzip", or empty for none
+}
+
+// DoRequestWithOptions is DoRequest with per-request options.
+func (hc *HTTPClient) DoRequestWithOptions(url, method string, body io.Reader, headers http.Header, options RequestOptions, metricsChannel chan<- metrics.Metrics) (HttpResponse, error) {
+	var events *traceLog
+	if options.Trace {
+		events = &traceLog{}
+	}
+	if options.NoMetrics {
+		metricsChannel = nil
+	}
+	if options.Compress != "" && body != nil {
+		compressed, err := compressBody(body, options.Compress)
+		if err != nil {
+			return HttpResponse{}, err
+		}
+		body = compressed
+		headers = headers.Clone()
+		if headers == nil {
+			headers = make(http.Header)
+		}
+		headers.Set("Content-Encoding", options.Compress)
+	}
+
+	// Retries and Digest challenges keep the slot, as they would a pooled
+	// connection; the wait for it isn't part of the response time.
+	release, err := acquireConcurrencySlot(RunContext())
+	if err != nil {
+		return HttpResponse{URL: url, Method: method}, err
+	}
+	defer release()
+
+	resp, err := hc.doWithRetries(url, method, body, headers, events, options.Tags, metricsChannel)
+	if events != nil {
+		resp.TraceEvents = events.all()
+	}
+	return resp, err
+}
+
+// compressBody returns the body compressed with the given Content-Encoding.
+func compressBody(body io.Reader, encoding string) (io.Reader, error) {
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported compression %q, only gzip is supported", encoding)
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := io.Copy(writer, body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return &compressed, nil
+}
+
+// maxRetryAfter caps the wait before a retry, so a server asking for a long
+// pause can't stall a virtual user for the rest of the test.
+const maxRetryAfter = time.Minute
+
+// doWithRetries sends the request, retrying rate-limited responses up to
+// MaxRetries times after the delay the server asked for. Every attempt,
+// including one answering a Digest challenge, is reported as a request of its
+// own.
+func (hc *HTTPClient) doWithRetries(url, method string, body io.Reader, headers http.Header, events *traceLog, tags map[string]string, metricsChannel chan<- metrics.Metrics) (HttpResponse, error) {
+	if hc.options.MaxRetries <= 0 && !hc.usesDigestAuth() {
+		return hc.doAuthenticated(url, method, func() io.Reader { return body }, headers, events, tags, metricsChannel)
+	}
+
+	// Keep the body so it can be sent again
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = io.ReadAll(body); err != nil {
+			return handleRequestError(err, url, method, time.Duration(0), 0, tags, metricsChannel)
+		}
+	}
+	newBody := func() io.Reader {
+		if body == nil {
+			return nil
+		}
+		return bytes.NewReader(payload)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := hc.doAuthenticated(url, method, newBody, headers, events, tags, metricsChannel)
+		if err != nil || attempt == hc.options.MaxRetries || !isRateLimited(resp.StatusCode, resp.Headers) {
+			return resp, err
+		}
+
+		timer := time.NewTimer(retryAfter(resp.Headers, time.Now()))
+		select {
+		case <-timer.C:
+		case <-RunContext().Done():
+			timer.Stop()
+			return resp, err
+		}
+	}
+}
+
+// isRateLimited reports whether a response asks the client to slow down: a 429,
+// or a 503 with a Retry-After header.
+func isRateLimited(statusCode int, headers http.Header) bool {
+	return statusCode == http.StatusTooManyRequests ||
+		(statusCode == http.StatusServiceUnavailable && headers.Get("Retry-After") != "")
+}
+
+// retryAfter returns how long to wait before retrying, from a Retry-After
+// header in seconds or as an HTTP date. Without a usable header it is one
+// second, and it is never longer than maxRetryAfter.
+func retryAfter(headers http.Header, now time.Time) time.Duration {
+	delay := time.Second
+	value := headers.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(now)
+	}
+
+	if delay < 0 {
+		return 0
+	}
+	if delay > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return delay
+}
+
+func (hc *HTTPClient) doRequest(url, method string, body io.Reader, headers http.Header, events *traceLog, tags map[string]string, metricsChannel chan<- metrics.Metrics) (HttpResponse, error) {
+	if started := atomic.AddInt64(&requestsStarted, 1); hc.options.MaxRequests > 0 && started > int64(hc.options.MaxRequests) {
+		return HttpResponse{Body: "Request limit reached", URL: url, Method: method}, nil
+	}
+
 	var dnsStart, dnsEnd, connectStart, connectEnd, wroteHeadersTime, wroteRequestTime, gotFirstResponseByteTime, tlsHandshakeStart, tlsHandshakeEnd time.Time
 	var bytesSent, bytesReceived int // To track total bytes sent/received
+	var remoteIP, tlsVersion, tlsCipherSuite string
+	var connReused bool
 
 	trace := &httptrace.ClientTrace{
-		DNSStart:          func(info httptrace.DNSStartInfo) { dnsStart = time.Now() },
-		DNSDone:           func(info httptrace.DNSDoneInfo) { dnsEnd = time.Now() },
-		ConnectStart:      func(network, addr string) { connectStart = time.Now() },
-		ConnectDone:       func(network, addr string, err error) { connectEnd = time.Now() },
-		TLSHandshakeStart: func() { tlsHandshakeStart = time.Now() },
-		TLSHandshakeDone:  func(state tls.ConnectionState, err error) { tlsHandshakeEnd = time.Now() },
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+			events.add("DNSStart", dnsStart, info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			dnsEnd = time.Now()
+			events.add("DNSDone", dnsEnd, describeDNSDone(info))
+		},
+		ConnectStart: func(network, addr string) {
+			connectStart = time.Now()
+			events.add("ConnectStart", connectStart, network+" "+addr)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			connectEnd = time.Now()
+			events.add("ConnectDone", connectEnd, describeResult(network+" "+addr, err))
+		},
+		TLSHandshakeStart: func() {
+			tlsHandshakeStart = time.Now()
+			events.add("TLSHandshakeStart", tlsHandshakeStart, "")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			tlsHandshakeEnd = time.Now()
+			if err == nil {
+				tlsVersion = tls.VersionName(state.Version)
+				tlsCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+			}
+			events.add("TLSHandshakeDone", tlsHandshakeEnd, describeResult(tls.VersionName(state.Version), err))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			remoteIP = remoteHost(info.Conn.RemoteAddr())
+			connReused = info.Reused
+			events.add("GotConn", time.Now(), fmt.Sprintf("%s reused=%t", info.Conn.RemoteAddr(), info.Reused))
+		},
 		GotFirstResponseByte: func() {
 			gotFirstResponseByteTime = time.Now()
+			events.add("GotFirstResponseByte", gotFirstResponseByteTime, "")
 		},
 		WroteHeaders: func() {
 			wroteHeadersTime = time.Now()
+			events.add("WroteHeaders", wroteHeadersTime, "")
 		},
 		WroteRequest: func(info httptrace.WroteRequestInfo) {
 			wroteRequestTime = time.Now()
+			events.add("WroteRequest", wroteRequestTime, describeResult("", info.Err))
 		},
 	}
 
-	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), method, url, body)
-	if err != nil {
-		return handleRequestError(err, url, method, time.Duration(0), metricsChannel)
+	// Buffer the body once so its size is known up front; this keeps the
+	// Content-Length header and lets BytesSent include the payload.
+	var requestBody io.Reader
+	if body != nil {
+		bodyBytes, err := io.ReadAll(body)
+		if err != nil {
+			return handleRequestError(err, url, method, time.Duration(0), 0, tags, metricsChannel)
+		}
+		bytesSent += len(bodyBytes)
+		requestBody = bytes.NewReader(bodyBytes)
 	}
 
-	req.Header.Set("User-Agent", "Accelira perf testing tool/1.0")
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(RunContext(), trace), method, url, requestBody)
+	if err != nil {
+		return handleRequestError(err, url, method, time.Duration(0), 0, tags, metricsChannel)
+	}
 
-	// Calculate request headers size
-	var reqHeadersSize int
-	for k, v := range req.Header {
-		reqHeadersSize += len(k) + len(v[0]) + 4 // "Key: Value\r\n"
+	userAgent := hc.options.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	if hc.options.ConditionalRequests {
+		hc.setConditionalHeaders(url, req)
+	}
+	var requestID string
+	if hc.options.TraceHeaders {
+		requestID = setTraceHeaders(req.Header)
 	}
-	bytesSent += reqHeadersSize
+
+	// Request line, Host header and headers as they would appear on the wire
+	bytesSent += requestHeadSize(req)
+
+	inFlightCounter := endpointInFlight(method, url)
+	inFlight := int(atomic.AddInt64(inFlightCounter, 1))
 
 	startTime := time.Now()
+	events.add("Start", startTime, "")
 	resp, err := hc.client.Do(req)
 	duration := time.Since(startTime)
 
+	atomic.AddInt64(inFlightCounter, -1)
+
 	if err != nil {
-		return handleRequestError(err, url, method, duration, metricsChannel)
+		return handleRequestError(err, url, method, duration, inFlight, tags, metricsChannel)
 	}
 	defer resp.Body.Close()
 
@@ -130,24 +515,27 @@ func (hc *HTTPClient) DoRequest(url, method string, body io.Reader, metricsChann
 	if err != nil {
 		return HttpResponse{}, err
 	}
+	bodyReceivedTime := time.Now()
+	events.add("BodyReceived", bodyReceivedTime, "")
 
-	// Calculate response headers size
-	var respHeadersSize int
-	for k, v := range resp.Header {
-		respHeadersSize += len(k) + len(v[0]) + 4 // "Key: Value\r\n"
-	}
-	bytesReceived += respHeadersSize
-	bytesReceived += int(bytesCopied) // Add the body size
+	// Status line and headers as they would appear on the wire
+	bytesReceived += responseHeadSize(resp)
 
-	// Adding the request body size if any
-	if body != nil {
-		bodySize, _ := io.Copy(io.Discard, body) // Measure body length
-		bytesSent += int(bodySize)
+	notModified := 0
+	if hc.options.ConditionalRequests {
+		hc.storeValidators(url, resp)
+		if resp.StatusCode == http.StatusNotModified {
+			notModified = 1
+		}
 	}
+	bytesReceived += int(bytesCopied) // Add the body size
 
-	if tlsHandshakeEnd.Sub(tlsHandshakeStart) > 100*time.Second {
+	if hc.options.TraceRequests && hc.sample(hc.options.TraceSampleRate) {
 		// Log detailed trace timings
-		fmt.Printf("result: %v\n", "============================")
+		fmt.Printf("\n============================ %s %s\n", method, url)
+		if requestID != "" {
+			fmt.Printf("Request ID: %s (traceparent %s)\n", requestID, req.Header.Get("Traceparent"))
+		}
 		fmt.Printf("DNS Lookup: %v\n", dnsEnd.Sub(dnsStart))
 		fmt.Printf("TCP Connection: %v\n", connectEnd.Sub(connectStart))
 		fmt.Printf("TLS Handshake: %v\n", tlsHandshakeEnd.Sub(tlsHandshakeStart))
@@ -157,24 +545,133 @@ func (hc *HTTPClient) DoRequest(url, method string, body io.Reader, metricsChann
 	}
 
 	httpResp := HttpResponse{
-		Body:                responseBody.String(),
+		Body:                decodeBody(responseBody.Bytes(), resp.Header.Get("Content-Type")),
+		BodyBytes:           responseBody.Bytes(),
 		StatusCode:          resp.StatusCode,
 		URL:                 url,
 		Method:              method,
 		Duration:            duration,
+		Headers:             resp.Header,
 		TCPHandshakeLatency: connectEnd.Sub(connectStart),
 		TLSHandshakeLatency: tlsHandshakeEnd.Sub(tlsHandshakeStart),
 		DNSLookupLatency:    dnsEnd.Sub(dnsStart),
+		TTFB:                gotFirstResponseByteTime.Sub(startTime),
+		BodyReceiveLatency:  bodyReceivedTime.Sub(gotFirstResponseByteTime),
+		RemoteIP:            remoteIP,
+		ConnReused:          connReused,
+		RequestID:           requestID,
+		BytesReceived:       bytesReceived,
+		BytesSent:           bytesSent,
+	}
+	if resp.TLS != nil {
+		// Unlike the handshake trace, this is also set on reused connections.
+		httpResp.TLSVersion = tls.VersionName(resp.TLS.Version)
+		httpResp.TLSCipherSuite = tls.CipherSuiteName(resp.TLS.CipherSuite)
+	}
+
+	unexpectedStatus := 0
+	if !hc.isExpectedStatus(resp.StatusCode) {
+		unexpectedStatus = 1
 	}
 
 	// Update metrics with bytes sent/received (including headers)
-	metrics1 := collectMetricsWithLatencies(url, method, 0, bytesReceived, bytesSent, resp.StatusCode, duration, httpResp.TCPHandshakeLatency, httpResp.TLSHandshakeLatency, httpResp.DNSLookupLatency)
+	metrics1 := collectMetricsWithLatencies(url, method, unexpectedStatus, bytesReceived, bytesSent, resp.StatusCode, duration, httpResp.TCPHandshakeLatency, httpResp.TLSHandshakeLatency, httpResp.DNSLookupLatency, httpResp.TTFB, httpResp.BodyReceiveLatency, inFlight)
+	endpointMetrics := metrics1.EndpointMetricsMap[fmt.Sprintf("%s %s", method, url)]
+	endpointMetrics.NotModified = notModified
+	endpointMetrics.RemoteIP = remoteIP
+	endpointMetrics.TLSVersion = tlsVersion
+	endpointMetrics.TLSCipherSuite = tlsCipherSuite
+	endpointMetrics.Tags = tags
+	if isRateLimited(resp.StatusCode, resp.Header) {
+		endpointMetrics.RateLimited = 1
+	}
+	if hc.options.MetricsSampleRate > 0 && !hc.sample(hc.options.MetricsSampleRate) {
+		endpointMetrics.Unsampled = true
+	}
+	// Counted by class whether or not the status is expected, so bad requests
+	// can be told apart from a failing server.
+	switch {
+	case resp.StatusCode >= 500:
+		endpointMetrics.ServerErrors = 1
+	case resp.StatusCode >= 400:
+		endpointMetrics.ClientErrors = 1
+	}
 	metrics.SendMetrics(metrics1, metricsChannel)
 
 	return httpResp, nil
 }
 
-func collectMetricsWithLatencies(url, method string, errors int, bytesReceived, bytesSent, statusCode int, duration, tcpHandshakeLatency, tlsHandshakeLatency, dnsLookupLatency time.Duration) metrics.Metrics {
+// setConditionalHeaders adds revalidation headers for a GET or HEAD request to a
+// URL with stored validators.
+func (hc *HTTPClient) setConditionalHeaders(url string, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return
+	}
+
+	hc.validatorsMutex.Lock()
+	validators, ok := hc.validators[url]
+	hc.validatorsMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	if validators.etag != "" {
+		req.Header.Set("If-None-Match", validators.etag)
+	}
+	if validators.lastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.lastModified)
+	}
+}
+
+// storeValidators remembers the ETag and Last-Modified of a successful response.
+func (hc *HTTPClient) storeValidators(url string, resp *http.Response) {
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	validators := cacheValidators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	if validators.etag == "" && validators.lastModified == "" {
+		return
+	}
+
+	hc.validatorsMutex.Lock()
+	hc.validators[url] = validators
+	hc.validatorsMutex.Unlock()
+}
+
+// headerSize returns the wire size of the headers, counting every value of a
+// multi-value header as its own "Key: Value\r\n" line.
+func headerSize(header http.Header) int {
+	size := 0
+	for k, values := range header {
+		for _, v := range values {
+			size += len(k) + len(v) + 4 // "Key: Value\r\n"
+		}
+	}
+	return size
+}
+
+// requestHeadSize approximates the bytes of the request line, Host header and
+// headers, terminated by the blank line before the body.
+func requestHeadSize(req *http.Request) int {
+	size := len(req.Method) + len(req.URL.RequestURI()) + len("HTTP/1.1") + 4 // "METHOD URI HTTP/1.1\r\n"
+	size += len("Host") + len(req.Host) + 4
+	size += headerSize(req.Header)
+	return size + 2
+}
+
+// responseHeadSize approximates the bytes of the status line and headers,
+// terminated by the blank line before the body.
+func responseHeadSize(resp *http.Response) int {
+	size := len(resp.Proto) + len(resp.Status) + 3 // "HTTP/1.1 200 OK\r\n"
+	size += headerSize(resp.Header)
+	return size + 2
+}
+
+func collectMetricsWithLatencies(url, method string, errors int, bytesReceived, bytesSent, statusCode int, duration, tcpHandshakeLatency, tlsHandshakeLatency, dnsLookupLatency, ttfb, bodyReceiveLatency time.Duration, inFlight int) metrics.Metrics {
 	key := fmt.Sprintf("%s %s", method, url)
 
 	epMetrics := &metrics.EndpointMetrics{
@@ -186,21 +683,118 @@ func collectMetricsWithLatencies(url, method string, errors int, bytesReceived,
 		TCPHandshakeLatency: tcpHandshakeLatency,
 		TLSHandshakeLatency: tlsHandshakeLatency,
 		DNSLookupLatency:    dnsLookupLatency,
+		TTFB:                ttfb,
+		BodyReceiveLatency:  bodyReceiveLatency,
 		BytesReceived:       bytesReceived,
 		BytesSent:           bytesSent,
 		Errors:              errors,
+		InFlight:            inFlight,
 	}
 
 	return metrics.Metrics{EndpointMetricsMap: map[string]*metrics.EndpointMetrics{key: epMetrics}}
 }
 
 type HttpResponse struct {
-	Body                string
+	Body                string // body as UTF-8 text, empty for binary content types
+	BodyBytes           []byte // body exactly as received
 	StatusCode          int
 	URL                 string
 	Method              string
 	Duration            time.Duration
+	Headers             http.Header
 	TCPHandshakeLatency time.Duration
 	TLSHandshakeLatency time.Duration
 	DNSLookupLatency    time.Duration
+	TTFB                time.Duration
+	BodyReceiveLatency  time.Duration
+	RemoteIP            string // address of the server that answered
+	ConnReused          bool   // whether the request reused a kept-alive connection
+	TLSVersion          string // TLS version of the connection, empty without TLS
+	TLSCipherSuite      string // cipher suite of the connection, empty without TLS
+	RequestID           string // X-Request-ID sent with TraceHeaders, empty otherwise
+	BytesReceived       int    // response size including status line and headers
+	BytesSent           int    // request size including request line and headers
+
+	// TraceEvents are the httptrace events of the request, only recorded when
+	// RequestOptions.Trace is set.
+	TraceEvents []TraceEvent
+}
+
+// TraceEvent is an httptrace event of a request, e.g. "DNSStart" or
+// "GotFirstResponseByte", with details such as the address connected to.
+type TraceEvent struct {
+	Event  string
+	Time   time.Time
+	Detail string
+}
+
+// traceLog collects the trace events of a request. Events can arrive from
+// several goroutines, e.g. when dialing addresses in parallel. A nil traceLog
+// records nothing, so untraced requests don't pay for it.
+type traceLog struct {
+	mutex  sync.Mutex
+	events []TraceEvent
+}
+
+func (l *traceLog) add(event string, at time.Time, detail string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, TraceEvent{Event: event, Time: at, Detail: detail})
+}
+
+func (l *traceLog) all() []TraceEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]TraceEvent{}, l.events...)
+}
+
+// describeDNSDone lists the resolved addresses, or the lookup error.
+func describeDNSDone(info httptrace.DNSDoneInfo) string {
+	if info.Err != nil {
+		return info.Err.Error()
+	}
+	addrs := make([]string, len(info.Addrs))
+	for i, addr := range info.Addrs {
+		addrs[i] = addr.String()
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// describeResult returns detail, or the error if there was one.
+func describeResult(detail string, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return detail
+}
+
+// resolvingDialContext dials the overridden address for hosts in
+// options.HostResolve, and resolves other hosts through the DNS cache if
+// options.DNSCache is set. The request itself is unchanged, so the Host header
+// and TLS SNI still carry the original host name.
+func resolvingDialContext(dialer *net.Dialer, options ClientOptions) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if override, ok := options.HostResolve[addr]; ok {
+			addr = override
+		}
+		if options.DNSCache {
+			return dialCached(ctx, dialer, network, addr, options.DNSCacheTTL)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// remoteHost returns the IP of a connection's remote address without the port.
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
 }
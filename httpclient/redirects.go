@@ -0,0 +1,44 @@
+package httpclient
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// DefaultMaxRedirects is the number of redirects a request follows when no
+// limit is configured, the same as net/http's.
+const DefaultMaxRedirects = 10
+
+// TooManyRedirectsError is returned when a request is redirected more often
+// than the limit allows, typically because of a redirect loop.
+type TooManyRedirectsError struct {
+	Redirects int    // redirects in the chain when it was stopped
+	Limit     int    // redirects the request was allowed to follow
+	Location  string // target of the redirect that wasn't followed
+}
+
+func (e *TooManyRedirectsError) Error() string {
+	return fmt.Sprintf("too many redirects: stopped after %d redirects (limit %d) before %s", e.Redirects, e.Limit, e.Location)
+}
+
+// checkRedirect returns the redirect policy of a client following at most max
+// redirects: 0 for DefaultMaxRedirects, negative to follow none and return
+// the redirect response itself.
+func checkRedirect(max int) func(req *http.Request, via []*http.Request) error {
+	if max < 0 {
+		return func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	limit := max
+	if limit == 0 {
+		limit = DefaultMaxRedirects
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		// via holds the requests sent so far, one per redirect received.
+		if len(via) > limit {
+			return &TooManyRedirectsError{Redirects: len(via), Limit: limit, Location: req.URL.String()}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,46 @@
+package httpclient
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatusRange is an inclusive range of HTTP status codes.
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// ParseStatusRange parses a status code such as "200", a range such as
+// "200-299" or a class such as "2xx".
+func ParseStatusRange(spec string) (StatusRange, error) {
+	trimmed := strings.TrimSpace(spec)
+	if len(trimmed) == 3 && strings.HasSuffix(strings.ToLower(trimmed), "xx") {
+		trimmed = trimmed[:1] + "00-" + trimmed[:1] + "99"
+	}
+	minSpec, maxSpec, isRange := strings.Cut(trimmed, "-")
+	if !isRange {
+		maxSpec = minSpec
+	}
+	min, minErr := strconv.Atoi(strings.TrimSpace(minSpec))
+	max, maxErr := strconv.Atoi(strings.TrimSpace(maxSpec))
+	if minErr != nil || maxErr != nil || min < 100 || max > 599 || min > max {
+		return StatusRange{}, fmt.Errorf("invalid expected status %q, expected a code such as 200, a range such as 200-299 or a class such as 2xx", spec)
+	}
+	return StatusRange{Min: min, Max: max}, nil
+}
+
+// isExpectedStatus reports whether a response status counts as successful.
+// Without ExpectedStatus every status does; failures are left to checks.
+func (hc *HTTPClient) isExpectedStatus(statusCode int) bool {
+	if len(hc.options.ExpectedStatus) == 0 {
+		return true
+	}
+	for _, statusRange := range hc.options.ExpectedStatus {
+		if statusCode >= statusRange.Min && statusCode <= statusRange.Max {
+			return true
+		}
+	}
+	return false
+}
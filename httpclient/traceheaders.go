@@ -0,0 +1,27 @@
+package httpclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// setTraceHeaders gives the request an X-Request-ID and a W3C traceparent
+// unless it already has them, so its traffic can be found in the target's
+// traces. Both carry the same ID. It returns the request's X-Request-ID.
+func setTraceHeaders(header http.Header) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	spanID := make([]byte, 8)
+	rand.Read(spanID)
+
+	if header.Get("X-Request-ID") == "" {
+		header.Set("X-Request-ID", fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16]))
+	}
+	if header.Get("Traceparent") == "" {
+		// Version 00, sampled, so the backend records the trace.
+		header.Set("Traceparent", "00-"+hex.EncodeToString(id)+"-"+hex.EncodeToString(spanID)+"-01")
+	}
+	return header.Get("X-Request-ID")
+}
@@ -1,26 +1,35 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/accelira/accelira/dashboard"
+	"github.com/accelira/accelira/distributed"
+	"github.com/accelira/accelira/httpclient"
 	"github.com/accelira/accelira/metrics"
 	"github.com/accelira/accelira/metricsprocessor"
 	"github.com/accelira/accelira/moduleloader"
 	"github.com/accelira/accelira/report"
 	"github.com/accelira/accelira/util"
 	"github.com/accelira/accelira/vmhandler"
+	"github.com/dop251/goja"
 	"github.com/evanw/esbuild/pkg/api"
+	"github.com/fatih/color"
 	"github.com/spf13/cobra"
 )
 
@@ -29,9 +38,6 @@ var (
 )
 
 func main() {
-	// Start the real-time monitoring dashboard
-	// go startDashboard()
-
 	//graceful shutdown
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt)
@@ -58,16 +64,103 @@ func createRootCommand() *cobra.Command {
 		Short: "Accelira performance testing tool",
 	}
 	rootCmd.AddCommand(createRunCommand())
+	rootCmd.AddCommand(createCoordinatorCommand())
+	rootCmd.AddCommand(createReportCommand())
 	return rootCmd
 }
 
 func createRunCommand() *cobra.Command {
-	return &cobra.Command{
+	runCmd := &cobra.Command{
 		Use:   "run [script]",
 		Short: "Run a JavaScript test script",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if worker, _ := cmd.Flags().GetBool("worker"); worker {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
+		Run: executeScript,
+	}
+	runCmd.Flags().Bool("trace-requests", false, "Log the DNS/TCP/TLS/write/TTFB breakdown for a sample of requests")
+	runCmd.Flags().Float64("trace-sample-rate", 0.01, "Fraction of requests to trace when --trace-requests is set")
+	runCmd.Flags().Bool("worker", false, "Run as a worker, receiving the script from a coordinator")
+	runCmd.Flags().String("coordinator", "", "Coordinator address (host:port) to connect to in worker mode")
+	runCmd.Flags().String("export-json", "", "Write the aggregated results to a JSON file (same as --out json=FILE)")
+	runCmd.Flags().StringArray("out", nil, "Additional output as name[=arg]: "+strings.Join(report.OutputNames(), ", "))
+	runCmd.Flags().Bool("dashboard", false, "Serve the live dashboard at http://localhost:8080 during the run")
+	runCmd.Flags().Duration("dashboard-interval", time.Second, "Interval at which the dashboard's metrics snapshot is refreshed")
+	runCmd.Flags().Bool("json-summary", false, "Print a compact JSON summary to stdout; the human-readable output goes to stderr")
+	runCmd.Flags().String("config", "", "Configuration file (.js or .json) applied over the script's configuration")
+	runCmd.Flags().String("env", "", "Name of the environment from config.setEnvironments() to expose via __ENV")
+	runCmd.Flags().Bool("dry-run", false, "Build the script, check the configuration and run a single iteration instead of the load test")
+	runCmd.Flags().String("exec", "", "Name of the exported function to run instead of the default export")
+	runCmd.Flags().Bool("by-url", false, "Add a report section combining the requests to each URL across methods")
+	runCmd.Flags().String("sort", "name", "Order of the report's endpoints: name, or descending by p95, requests or errors")
+	runCmd.Flags().StringArray("only-tag", nil, "Only report endpoints and groups tagged key=value via params.tags (repeatable)")
+	runCmd.Flags().StringArray("tag", nil, "Tag every metric of the run with key=value, e.g. build=1234 (repeatable)")
+	runCmd.Flags().StringSlice("summary-percentiles", nil, "Latency percentiles shown in the report and JSON export, e.g. p90,p99,p99.9 (default p90,p95)")
+	runCmd.Flags().Duration("time-bucket", metricsprocessor.TimeSeriesInterval, "Interval of the latency time series in the report and JSON export, 0 to disable")
+	runCmd.Flags().Int("metrics-buffer", 0, "Capacity of the metrics channel (default 5 per concurrent user)")
+	runCmd.Flags().Int("max-endpoints", 0, "Maximum distinct endpoints tracked; the rest are grouped as \"other\" (0 for no limit)")
+	runCmd.Flags().Int("gc-percent", 100, "Go garbage collector target percentage (GOGC); higher trades memory for less GC work, -1 disables GC")
+	runCmd.Flags().Int("max-procs", 0, "Maximum CPUs executing Go code at once (GOMAXPROCS), 0 for all")
+	return runCmd
+}
+
+func createCoordinatorCommand() *cobra.Command {
+	coordinatorCmd := &cobra.Command{
+		Use:   "coordinator [script]",
+		Short: "Distribute a test script across workers and combine their results",
 		Args:  cobra.ExactArgs(1),
-		Run:   executeScript,
+		Run:   executeCoordinator,
 	}
+	coordinatorCmd.Flags().String("listen", ":7070", "Address to accept workers on")
+	coordinatorCmd.Flags().Int("workers", 1, "Number of workers to wait for before starting")
+	coordinatorCmd.Flags().Duration("snapshot-interval", 5*time.Second, "How often workers send their metrics so far, 0 to send them only at the end")
+	coordinatorCmd.Flags().String("export-json", "", "Write the combined results to a JSON file (same as --out json=FILE)")
+	coordinatorCmd.Flags().StringArray("out", nil, "Additional output as name[=arg]: "+strings.Join(report.OutputNames(), ", "))
+	coordinatorCmd.Flags().Bool("json-summary", false, "Print a compact JSON summary to stdout; the human-readable output goes to stderr")
+	coordinatorCmd.Flags().String("config", "", "Configuration file (.js or .json) applied over the script's configuration")
+	coordinatorCmd.Flags().Bool("by-url", false, "Add a report section combining the requests to each URL across methods")
+	coordinatorCmd.Flags().String("sort", "name", "Order of the report's endpoints: name, or descending by p95, requests or errors")
+	coordinatorCmd.Flags().StringArray("only-tag", nil, "Only report endpoints and groups tagged key=value via params.tags (repeatable)")
+	coordinatorCmd.Flags().StringArray("tag", nil, "Tag every metric of the run with key=value, e.g. build=1234 (repeatable)")
+	return coordinatorCmd
+}
+
+func createReportCommand() *cobra.Command {
+	reportCmd := &cobra.Command{
+		Use:   "report",
+		Short: "Work with exported JSON results",
+	}
+
+	mergeCmd := &cobra.Command{
+		Use:   "merge [results.json...]",
+		Short: "Merge exported results into a single report",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   executeReportMerge,
+	}
+	mergeCmd.Flags().String("export-json", "", "Write the merged results to a JSON file instead of printing them")
+	mergeCmd.Flags().Bool("by-url", false, "Add a report section combining the requests to each URL across methods")
+	mergeCmd.Flags().String("sort", "name", "Order of the report's endpoints: name, or descending by p95, requests or errors")
+	mergeCmd.Flags().StringArray("only-tag", nil, "Only report endpoints and groups tagged key=value via params.tags (repeatable)")
+	reportCmd.AddCommand(mergeCmd)
+
+	compareCmd := &cobra.Command{
+		Use:   "compare",
+		Short: "Compare results against a baseline and fail on regressions",
+		Args:  cobra.NoArgs,
+		Run:   executeReportCompare,
+	}
+	compareCmd.Flags().String("baseline", "", "Baseline results JSON file")
+	compareCmd.Flags().String("current", "", "Current results JSON file")
+	compareCmd.Flags().String("threshold", "10%", "Maximum allowed p95 increase, e.g. 10%")
+	compareCmd.Flags().Float64("error-threshold", 0, "Maximum allowed error rate increase in percentage points")
+	compareCmd.MarkFlagRequired("baseline")
+	compareCmd.MarkFlagRequired("current")
+	reportCmd.AddCommand(compareCmd)
+
+	return reportCmd
 }
 
 func printMemoryUsage() {
@@ -81,17 +174,41 @@ func bToMb(b uint64) uint64 {
 	return b / 1024 / 1024
 }
 
+// externalModules are provided by the Go runtime through require() and must
+// not be bundled. Every other import, including packages from node_modules, is
+// resolved and inlined by esbuild.
+var externalModules = []string{
+	"Accelira/http", "Accelira/assert", "Accelira/config",
+	"Accelira/group", "Accelira/data", "jsonwebtoken", "crypto", "fs",
+}
+
+// scriptLoaders maps script extensions to esbuild loaders. TypeScript is only
+// transpiled (types are stripped), it is not type-checked.
+var scriptLoaders = map[string]api.Loader{
+	".js":  api.LoaderJS,
+	".mjs": api.LoaderJS,
+	".cjs": api.LoaderJS,
+	".ts":  api.LoaderTS,
+	".mts": api.LoaderTS,
+	".cts": api.LoaderTS,
+}
+
 func buildJavaScriptCode(scriptPath string) (string, error) {
+	absScriptPath, err := filepath.Abs(scriptPath)
+	if err != nil {
+		return "", fmt.Errorf("error resolving script path: %w", err)
+	}
+
 	result := api.Build(api.BuildOptions{
-		EntryPoints: []string{scriptPath},
-		Bundle:      true,
-		Format:      api.FormatCommonJS,
-		Platform:    api.PlatformNeutral,
-		Target:      api.ES2015,
-		External: []string{
-			"Accelira/http", "Accelira/assert", "Accelira/config",
-			"Accelira/group", "jsonwebtoken", "crypto", "fs",
-		},
+		EntryPoints:   []string{absScriptPath},
+		AbsWorkingDir: filepath.Dir(absScriptPath),
+		Bundle:        true,
+		Format:        api.FormatCommonJS,
+		Platform:      api.PlatformNeutral,
+		MainFields:    []string{"module", "main"},
+		Loader:        scriptLoaders,
+		Target:        api.ES2015,
+		External:      externalModules,
 	})
 
 	if len(result.Errors) > 0 {
@@ -101,58 +218,552 @@ func buildJavaScriptCode(scriptPath string) (string, error) {
 	return string(result.OutputFiles[0].Contents), nil
 }
 
-func setupVM(code string) (*moduleloader.Config, error) {
-	_, config, err := vmhandler.CreateConfigVM(code)
+func setupVM(code string, scriptDir string) (*goja.Runtime, *moduleloader.Config, error) {
+	vm, config, err := vmhandler.CreateConfigVM(code, scriptDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create VM config: %w", err)
+		return nil, nil, fmt.Errorf("failed to create VM config: %w", err)
 	}
-	return config, nil
+	return vm, config, nil
 }
 
-func startMetricsCollection(metricsChannel chan metrics.Metrics) {
+func startMetricsCollection(metricsChannel chan metrics.Metrics, outputs []report.Output) {
+	var handlers []func(metrics.Metrics)
+	for _, output := range outputs {
+		if streaming, ok := output.(report.StreamingOutput); ok {
+			handlers = append(handlers, streaming.HandleMetric)
+		}
+	}
+
 	metricsWaitGroup.Add(1)
-	go metricsprocessor.GatherMetrics(metricsChannel, &metricsWaitGroup)
+	go metricsprocessor.GatherMetrics(metricsChannel, &metricsWaitGroup, handlers...)
 }
 
 func executeScript(cmd *cobra.Command, args []string) {
+	summaryWriter := jsonSummaryWriter(cmd)
 	util.DisplayLogo()
+	applyRuntimeTuning(cmd)
+
+	if worker, _ := cmd.Flags().GetBool("worker"); worker {
+		executeWorker(cmd)
+		return
+	}
 
 	builtCode, err := buildJavaScriptCode(args[0])
 	checkError("Error building JavaScript", err)
 
-	vmConfig, err := setupVM(builtCode)
+	configVM, vmConfig, err := setupVM(builtCode, filepath.Dir(args[0]))
 	checkError("Error setting up VM", err)
+	checkError("Error loading config file", applyConfigFile(cmd, vmConfig))
+
+	applyRunFlags(cmd, vmConfig)
+	checkError("Invalid configuration", validateConfig(vmConfig))
+	checkError("Invalid summary percentiles", applySummaryPercentiles(vmConfig))
+	report.MetricsSampleRate = vmConfig.MetricsSampleRate
+	checkError("Invalid --only-tag", applyOnlyTags(cmd))
+	checkError("Invalid --tag", applyRunTags(cmd))
+	checkError("Invalid --sort", applySortOrder(cmd))
 
 	displayConfig(vmConfig)
 
-	metricsChannel := make(chan metrics.Metrics, vmConfig.ConcurrentUsers*5)
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		executeDryRun(builtCode, vmConfig)
+		return
+	}
 
-	startMetricsCollection(metricsChannel)
+	outputs := createOutputs(cmd)
+	if summaryWriter != nil {
+		outputs = append(outputs, report.NewJSONSummaryOutput(summaryWriter))
+	}
+	if enabled, _ := cmd.Flags().GetBool("dashboard"); enabled {
+		outputs = append(outputs, startDashboard(cmd))
+	}
 
-	executeTestScripts(builtCode, vmConfig, metricsChannel)
+	runLoadTest(builtCode, vmConfig, outputs)
 
+	handleSummary(outputs)
+	runScriptSummary(configVM)
+	os.Exit(exitCode())
+}
+
+// executeDryRun runs one iteration of the script and prints its report, to
+// catch scripting errors before a full load test.
+func executeDryRun(code string, vmConfig *moduleloader.Config) {
+	fmt.Println("Dry run: running a single iteration")
+
+	metricsChannel := make(chan metrics.Metrics, 1000)
+	startMetricsCollection(metricsChannel, nil)
+	err := vmhandler.RunIteration(context.Background(), code, vmConfig, metricsChannel)
 	close(metricsChannel)
 	metricsWaitGroup.Wait()
 
-	// report.GenerateReport(&metricsprocessor.MetricsMap)
-	reportGenerator := report.NewReportGenerator(&metricsprocessor.MetricsMap)
+	consoleOutput, _ := report.NewOutput("console")
+	handleSummary([]report.Output{consoleOutput})
+	checkError("Dry run failed", err)
+
+	fmt.Println("\nDry run passed")
+	os.Exit(exitCode())
+}
+
+// jsonSummaryWriter moves the human-readable output to stderr when
+// --json-summary is set, so that stdout only carries the JSON summary. It
+// returns the original stdout, or nil without the flag.
+func jsonSummaryWriter(cmd *cobra.Command) io.Writer {
+	if enabled, _ := cmd.Flags().GetBool("json-summary"); !enabled {
+		return nil
+	}
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	color.Output = color.Error
+	return stdout
+}
+
+// createOutputs returns the console report followed by the outputs selected
+// with --out and --export-json.
+func createOutputs(cmd *cobra.Command) []report.Output {
+	specs, _ := cmd.Flags().GetStringArray("out")
+	if path, _ := cmd.Flags().GetString("export-json"); path != "" {
+		specs = append(specs, "json="+path)
+	}
+
+	outputs := []report.Output{}
+	consoleOutput, _ := report.NewOutput("console")
+	outputs = append(outputs, consoleOutput)
+
+	for _, spec := range specs {
+		if spec == "console" {
+			continue
+		}
+		output, err := report.NewOutput(spec)
+		checkError("Invalid output", err)
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+// runScriptSummary writes the files returned by the script's handleSummary
+// function. The file name "stdout" prints the content instead.
+func runScriptSummary(vm *goja.Runtime) {
+	files, err := vmhandler.RunHandleSummary(vm, metricsprocessor.MetricsMap)
+	if err != nil {
+		fmt.Printf("Error running handleSummary: %v\n", err)
+		return
+	}
+
+	for name, content := range files {
+		if name == "stdout" {
+			fmt.Println(content)
+			continue
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			fmt.Printf("Error writing %s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("Summary written to %s\n", name)
+	}
+}
+
+// handleSummary passes the aggregated results to every output.
+func handleSummary(outputs []report.Output) {
+	for _, output := range outputs {
+		if err := output.HandleSummary(&metricsprocessor.MetricsMap); err != nil {
+			fmt.Printf("Error writing output: %v\n", err)
+		}
+	}
+}
+
+// executeReportMerge merges exported result files and prints or exports the
+// combined results.
+func executeReportMerge(cmd *cobra.Command, args []string) {
+	checkError("Invalid --only-tag", applyOnlyTags(cmd))
+	checkError("Invalid --sort", applySortOrder(cmd))
+	for _, path := range args {
+		results, err := report.ReadJSON(path)
+		checkError("Error loading results", err)
+		for key, aggregated := range results {
+			metricsprocessor.MergeAggregated(key, aggregated)
+		}
+	}
+
+	spec := "console"
+	if path, _ := cmd.Flags().GetString("export-json"); path != "" {
+		spec = "json=" + path
+	}
+
+	output, err := report.NewOutput(spec)
+	checkError("Invalid output", err)
+	handleSummary([]report.Output{output})
+}
+
+// applyConfigFile applies the file given with --config over the script's
+// configuration. JSON files map option names to setters, e.g. {"vus": 10};
+// scripts use the config module like a test script does.
+func applyConfigFile(cmd *cobra.Command, vmConfig *moduleloader.Config) error {
+	path, _ := cmd.Flags().GetString("config")
+	if path == "" {
+		return nil
+	}
+
+	if filepath.Ext(path) == ".json" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal(data, &values); err != nil {
+			return fmt.Errorf("error decoding %s: %w", path, err)
+		}
+		return moduleloader.ApplyConfigValues(vmConfig, values)
+	}
+
+	code, err := buildJavaScriptCode(path)
+	if err != nil {
+		return err
+	}
+	return vmhandler.ApplyConfigScript(code, vmConfig)
+}
+
+// applyRunFlags overrides the script's configuration with command-line flags.
+func applyRunFlags(cmd *cobra.Command, vmConfig *moduleloader.Config) {
+	vmConfig.TraceRequests, _ = cmd.Flags().GetBool("trace-requests")
+	vmConfig.TraceSampleRate, _ = cmd.Flags().GetFloat64("trace-sample-rate")
+	if bufferSize, _ := cmd.Flags().GetInt("metrics-buffer"); bufferSize > 0 {
+		vmConfig.MetricsBufferSize = bufferSize
+	}
+	if env, _ := cmd.Flags().GetString("env"); env != "" {
+		vmConfig.Env = env
+	}
+	if exec, _ := cmd.Flags().GetString("exec"); exec != "" {
+		vmConfig.Exec = exec
+	}
+	if percentiles, _ := cmd.Flags().GetStringSlice("summary-percentiles"); len(percentiles) > 0 {
+		vmConfig.SummaryPercentiles = percentiles
+	}
+	metricsprocessor.MaxEndpointKeys, _ = cmd.Flags().GetInt("max-endpoints")
+	metricsprocessor.TimeSeriesInterval, _ = cmd.Flags().GetDuration("time-bucket")
+}
+
+// applyRuntimeTuning applies --gc-percent and --max-procs to the Go runtime.
+// Flags that aren't given leave the runtime's defaults, including GOGC and
+// GOMAXPROCS from the environment.
+func applyRuntimeTuning(cmd *cobra.Command) {
+	if cmd.Flags().Changed("gc-percent") {
+		gcPercent, _ := cmd.Flags().GetInt("gc-percent")
+		debug.SetGCPercent(gcPercent)
+		fmt.Printf("GC Percent: %d\n", gcPercent)
+	}
+	if maxProcs, _ := cmd.Flags().GetInt("max-procs"); maxProcs > 0 {
+		runtime.GOMAXPROCS(maxProcs)
+		fmt.Printf("Max Procs: %d of %d CPUs\n", maxProcs, runtime.NumCPU())
+	}
+}
+
+// runLoadTest runs the script with the given configuration and waits until all
+// metrics have been aggregated into metricsprocessor.MetricsMap.
+func runLoadTest(code string, vmConfig *moduleloader.Config, outputs []report.Output) {
+	bufferSize := vmConfig.MetricsBufferSize
+	if bufferSize <= 0 {
+		bufferSize = vmConfig.ConcurrentUsers * 5
+	}
+	metricsChannel := make(chan metrics.Metrics, bufferSize)
+
+	startMetricsCollection(metricsChannel, outputs)
+
+	executeTestScripts(code, vmConfig, metricsChannel)
+
+	close(metricsChannel)
+	metricsWaitGroup.Wait()
+}
+
+// executeWorker receives a script from the coordinator, runs it and streams
+// the aggregated metrics back.
+func executeWorker(cmd *cobra.Command) {
+	coordinatorAddress, _ := cmd.Flags().GetString("coordinator")
+	if coordinatorAddress == "" {
+		log.Fatalf("--coordinator is required in worker mode")
+	}
+
+	fmt.Printf("Waiting for a job from coordinator %s\n", coordinatorAddress)
+	err := distributed.RunWorker(coordinatorAddress, func(job distributed.Job, stream *distributed.Stream) error {
+		vmConfig := job.Config
+		applyRunFlags(cmd, &vmConfig)
+		displayConfig(&vmConfig)
+
+		runLoadTest(job.Script, &vmConfig, []report.Output{stream})
+		return nil
+	})
+	checkError("Error running worker", err)
+
+	fmt.Println("Results sent to coordinator")
+}
+
+// executeCoordinator sends the script to every worker, merges their metrics
+// and prints the combined report.
+func executeCoordinator(cmd *cobra.Command, args []string) {
+	summaryWriter := jsonSummaryWriter(cmd)
+	util.DisplayLogo()
+
+	builtCode, err := buildJavaScriptCode(args[0])
+	checkError("Error building JavaScript", err)
+
+	configVM, vmConfig, err := setupVM(builtCode, filepath.Dir(args[0]))
+	checkError("Error setting up VM", err)
+	checkError("Error loading config file", applyConfigFile(cmd, vmConfig))
+	checkError("Invalid configuration", validateConfig(vmConfig))
+	checkError("Invalid summary percentiles", applySummaryPercentiles(vmConfig))
+	report.MetricsSampleRate = vmConfig.MetricsSampleRate
+	checkError("Invalid --only-tag", applyOnlyTags(cmd))
+	checkError("Invalid --tag", applyRunTags(cmd))
+	checkError("Invalid --sort", applySortOrder(cmd))
+
+	displayConfig(vmConfig)
+
+	outputs := createOutputs(cmd)
+	if summaryWriter != nil {
+		outputs = append(outputs, report.NewJSONSummaryOutput(summaryWriter))
+	}
+
+	listenAddress, _ := cmd.Flags().GetString("listen")
+	workers, _ := cmd.Flags().GetInt("workers")
+	snapshotInterval, _ := cmd.Flags().GetDuration("snapshot-interval")
+
+	coordinator, err := distributed.NewCoordinator(listenAddress, workers)
+	checkError("Error starting coordinator", err)
+
+	// The script is already bundled; files it reads at runtime are resolved
+	// on each worker, not against the coordinator's script directory.
+	job := distributed.Job{Script: builtCode, Config: *vmConfig, SnapshotInterval: snapshotInterval}
+	job.Config.ScriptDir = ""
+	jobs, err := job.Split(workers)
+	checkError(fmt.Sprintf("Invalid configuration for %d workers", workers), err)
+
+	// Every snapshot replaces the worker's previous one, so a worker that is
+	// lost mid-run still contributes what it sent last.
+	var latestMutex sync.Mutex
+	latest := make(map[string]distributed.Result)
+
+	fmt.Printf("Waiting for %d worker(s) on %s\n", workers, coordinator.Addr())
+	err = coordinator.Run(jobs, func(worker string, result distributed.Result) {
+		latestMutex.Lock()
+		latest[worker] = result
+		latestMutex.Unlock()
+
+		if !result.Final {
+			fmt.Printf("Worker %s: %d requests so far\n", worker, countRequests(result.Metrics))
+			return
+		}
+		if result.Error != "" {
+			fmt.Printf("Worker %s failed: %s\n", worker, result.Error)
+		}
+		fmt.Printf("Received results from worker %s\n", worker)
+	})
+	if err != nil {
+		if len(latest) == 0 {
+			checkError("Error running distributed test", err)
+		}
+		fmt.Printf("Error running distributed test: %v\nReporting the last snapshot of every worker\n", err)
+		workersLost = true
+	}
+
+	for _, result := range latest {
+		for key, aggregated := range result.Metrics {
+			metricsprocessor.MergeAggregated(key, aggregated)
+		}
+	}
+
+	handleSummary(outputs)
+	runScriptSummary(configVM)
+	os.Exit(exitCode())
+}
 
-	// Generate the report
-	reportGenerator.GenerateReport()
+// executeReportCompare compares two exported runs and exits non-zero when any
+// endpoint regressed beyond the threshold.
+func executeReportCompare(cmd *cobra.Command, args []string) {
+	baselinePath, _ := cmd.Flags().GetString("baseline")
+	currentPath, _ := cmd.Flags().GetString("current")
+	thresholdFlag, _ := cmd.Flags().GetString("threshold")
+
+	threshold, err := strconv.ParseFloat(strings.TrimSuffix(thresholdFlag, "%"), 64)
+	checkError("Invalid threshold", err)
+	errorThreshold, _ := cmd.Flags().GetFloat64("error-threshold")
+
+	baseline, err := report.ReadJSON(baselinePath)
+	checkError("Error loading baseline", err)
+	current, err := report.ReadJSON(currentPath)
+	checkError("Error loading current results", err)
+
+	if report.PrintComparison(report.Compare(baseline, current, threshold, errorThreshold), threshold, errorThreshold) {
+		fmt.Println("\nPerformance regression detected")
+		os.Exit(1)
+	}
+}
+
+// applySummaryPercentiles makes the report show the configured percentiles.
+func applySummaryPercentiles(c *moduleloader.Config) error {
+	if len(c.SummaryPercentiles) == 0 {
+		return nil
+	}
+	percentiles, err := report.ParsePercentiles(c.SummaryPercentiles)
+	if err != nil {
+		return err
+	}
+	report.SummaryPercentiles = percentiles
+	return nil
+}
+
+// applyOnlyTags restricts the report to the tags given with --only-tag.
+func applyOnlyTags(cmd *cobra.Command) error {
+	specs, _ := cmd.Flags().GetStringArray("only-tag")
+	if len(specs) == 0 {
+		return nil
+	}
+	tags, err := report.ParseTags(specs)
+	if err != nil {
+		return err
+	}
+	report.OnlyTags = tags
+	return nil
+}
+
+// applyRunTags attaches the tags given with --tag to every metric of the run.
+func applyRunTags(cmd *cobra.Command) error {
+	specs, _ := cmd.Flags().GetStringArray("tag")
+	if len(specs) == 0 {
+		return nil
+	}
+	tags, err := report.ParseTags(specs)
+	if err != nil {
+		return err
+	}
+	metrics.SetRunTags(tags)
+	return nil
+}
+
+// applySortOrder orders the report's endpoints as given with --sort, and adds
+// the URL totals with --by-url.
+func applySortOrder(cmd *cobra.Command) error {
+	report.ByURL, _ = cmd.Flags().GetBool("by-url")
+	order, _ := cmd.Flags().GetString("sort")
+	sortBy, err := report.ParseSortOrder(order)
+	if err != nil {
+		return err
+	}
+	report.SortBy = sortBy
+	return nil
+}
+
+// validateConfig rejects configurations that would not run any iterations.
+func validateConfig(c *moduleloader.Config) error {
+	if c.Duration <= 0 {
+		return fmt.Errorf("no duration set, call config.setDuration() (iterations are bounded by the duration)")
+	}
+	if c.ConcurrentUsers <= 0 {
+		return fmt.Errorf("no virtual users set, call config.setVUs()")
+	}
+	if _, ok := c.Environments[c.Env]; c.Env != "" && !ok {
+		return fmt.Errorf("unknown environment %q, define it with config.setEnvironments()", c.Env)
+	}
+	return nil
 }
 
 func displayConfig(c *moduleloader.Config) {
 
 	fmt.Printf("Concurrent Users: %d\nRamp-up Rate: %d\nDuration: %s\n",
 		c.ConcurrentUsers, c.RampUpRate, c.Duration)
+	if c.Warmup > 0 {
+		fmt.Printf("Warm-up: %s\n", c.Warmup)
+	}
+	if c.GracefulStop > 0 {
+		fmt.Printf("Graceful Stop: %s\n", c.GracefulStop)
+	}
+	if c.MaxRequests > 0 {
+		fmt.Printf("Max Requests: %d\n", c.MaxRequests)
+	}
+	if c.VURate > 0 {
+		fmt.Printf("Rate per User: %g/s\n", c.VURate)
+	}
+	if c.Env != "" {
+		fmt.Printf("Environment: %s\n", c.Env)
+	}
+	if c.SharedIterations > 0 {
+		fmt.Printf("Shared Iterations: %d\n", c.SharedIterations)
+	}
+	if c.Exec != "" {
+		fmt.Printf("Exec: %s\n", c.Exec)
+	}
+	if len(c.URLList) > 0 {
+		fmt.Printf("URL List: %d entries\n", len(c.URLList))
+	}
+	if len(c.RateStages) > 0 {
+		stages := make([]string, len(c.RateStages))
+		for i, stage := range c.RateStages {
+			stages[i] = fmt.Sprintf("%g/s over %s", stage.Target, stage.Duration)
+		}
+		fmt.Printf("Rate Stages: %s\n", strings.Join(stages, ", "))
+	}
+	if c.DNSCache {
+		ttl := "whole run"
+		if c.DNSCacheTTL > 0 {
+			ttl = c.DNSCacheTTL.String()
+		}
+		fmt.Printf("DNS Cache: enabled (TTL %s)\n", ttl)
+	}
+	if c.MetricsSampleRate > 0 && c.MetricsSampleRate < 1 {
+		fmt.Printf("Metrics Sample Rate: %g%%\n", c.MetricsSampleRate*100)
+	}
+	if c.NoTLSResumption {
+		fmt.Println("TLS Session Resumption: disabled")
+	}
+	if c.ConnectTimeout > 0 {
+		fmt.Printf("Connect Timeout: %s\n", c.ConnectTimeout)
+	}
+	if c.MaxConcurrent > 0 {
+		policy := c.MaxConcurrentPolicy
+		if policy == "" {
+			policy = "wait"
+		}
+		fmt.Printf("Max Concurrent: %d (%s)\n", c.MaxConcurrent, policy)
+	}
 }
 
 func executeTestScripts(code string, config *moduleloader.Config, metricsChannel chan<- metrics.Metrics) {
-	vmPool, err := vmhandler.NewVMPool(config.ConcurrentUsers, config, metricsChannel)
+	vmPool, err := vmhandler.NewVMPoolWithScript(config.ConcurrentUsers, code, config, metricsChannel)
 	checkError("Error initializing VM pool\n", err)
 
 	var waitGroup sync.WaitGroup
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	httpclient.SetRunContext(ctx)
+	vmhandler.SetStopFunc(cancel)
+
+	// A setup export runs once before anything else; every iteration gets
+	// a copy of what it returns.
+	if ran, err := vmhandler.RunSetup(ctx, vmPool); err != nil {
+		log.Fatalf("Error running setup(): %v", err)
+	} else if ran {
+		fmt.Println("setup() completed")
+	}
+
+	// Without a warm-up period, a warmup export runs once before the VUs
+	// start; with one, the VUs run it during the period instead.
+	if config.Warmup == 0 {
+		if ran, err := vmhandler.RunWarmup(ctx, vmPool); err != nil {
+			fmt.Println("Error running warmup():", err)
+		} else if ran {
+			fmt.Println("warmup() completed")
+		}
+	}
+
+	// Metrics are discarded during warm-up so cold-start handshakes don't
+	// skew the report.
+	measuredStart := time.Now().Add(config.Warmup)
+	vmhandler.SetMeasuredStart(measuredStart)
+	if config.Warmup > 0 {
+		metrics.PauseRecording()
+		time.AfterFunc(config.Warmup, metrics.ResumeRecording)
+	}
+	totalDuration := config.Warmup + config.Duration
+
 	// Start the progress bar goroutine
 	done := make(chan struct{})
 	go func() {
@@ -167,19 +778,21 @@ func executeTestScripts(code string, config *moduleloader.Config, metricsChannel
 				return
 			default:
 				elapsed := time.Since(startTime)
-				progress := elapsed.Seconds() / config.Duration.Seconds()
+				progress := elapsed.Seconds() / totalDuration.Seconds()
 				if progress > 1.0 {
 					progress = 1.0
 				}
 				filledLength := int(progress * float64(progressBarLength))
 				bar := fmt.Sprintf(
-					"\033[0G\033[32m[%s%s]\033[0m %.2f%% \033[33mElapsed:\033[0m %.2f sec / %.2f sec, \033[34mResponses received:\033[0m %d",
+					"\033[0G\033[32m[%s%s]\033[0m %.2f%% \033[33mElapsed:\033[0m %.2f sec / %.2f sec, \033[34mResponses received:\033[0m %d, \033[35mMetrics queue:\033[0m %d/%d, dropped %d",
 					strings.Repeat("▓", filledLength),
 					strings.Repeat("░", progressBarLength-filledLength),
 					progress*100,
 					elapsed.Seconds(),
-					config.Duration.Seconds(),
+					totalDuration.Seconds(),
 					atomic.LoadInt32(&metricsprocessor.MetricsReceived),
+					len(metricsChannel), cap(metricsChannel),
+					metrics.DroppedMetrics(),
 				)
 
 				// Update the terminal display
@@ -191,12 +804,22 @@ func executeTestScripts(code string, config *moduleloader.Config, metricsChannel
 
 	for i := 0; i < config.ConcurrentUsers; i++ {
 		waitGroup.Add(1)
-		go vmhandler.RunScriptWithPool(code, metricsChannel, &waitGroup, config, vmPool)
+		go vmhandler.RunScriptWithPool(ctx, metricsChannel, &waitGroup, config, vmPool)
 		if config.RampUpRate > 0 {
 			time.Sleep(time.Duration(1000/config.RampUpRate) * time.Millisecond)
 		}
 	}
 
+	// Once the last VU's duration ends, in-flight iterations get the graceful
+	// stop period to finish before they are cut off.
+	if config.GracefulStop > 0 {
+		if time.Now().After(measuredStart) {
+			measuredStart = time.Now()
+		}
+		hardStop := time.AfterFunc(time.Until(measuredStart.Add(config.Duration+config.GracefulStop)), cancel)
+		defer hardStop.Stop()
+	}
+
 	waitGroup.Wait()
 	close(done) // Signal the progress bar goroutine to stop
 
@@ -204,51 +827,81 @@ func executeTestScripts(code string, config *moduleloader.Config, metricsChannel
 	progressBarLength := 50
 	fmt.Printf("\033[0G\033[32m[%s]\033[0m 100%% \033[33mElapsed:\033[0m %.2f sec / %.2f sec\n",
 		strings.Repeat("▓", progressBarLength),
-		config.Duration.Seconds(),
-		config.Duration.Seconds(),
+		totalDuration.Seconds(),
+		totalDuration.Seconds(),
 	)
-}
 
-func checkError(message string, err error) {
-	if err != nil {
-		log.Fatalf("%s: %v", message, err)
+	if vmhandler.RequestLimitReached(config) {
+		fmt.Printf("Request limit of %d reached, stopping early\n", config.MaxRequests)
+	}
+	if reason := vmhandler.StopReason(); reason != "" {
+		fmt.Printf("Test stopped early: %s\n", reason)
+	}
+	if vmPool.SharedIterationsDone() {
+		fmt.Printf("All %d shared iterations completed\n", config.SharedIterations)
+	}
+	if dropped := vmhandler.DroppedIterations(); dropped > 0 {
+		fmt.Printf("Dropped iterations: %d (too many iterations waiting for a free VU, raise config.setVUs)\n", dropped)
+	}
+	if config.DNSCache {
+		hits, misses := httpclient.DNSCacheStats()
+		fmt.Printf("DNS cache: %d hits, %d misses\n", hits, misses)
 	}
 }
 
-const htmlContent = dashboard.HtmlContent
-
-func startDashboard() {
-	// Serve the dashboard HTML content at the root path
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		w.Write([]byte(htmlContent))
-	})
-
-	// Serve the metrics at a different endpoint
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		metrics1 := make(map[string]map[string]interface{})
-
-		// Iterate over the map
-		for key, value := range metricsprocessor.MetricsMap {
-			// Directly use value since it's already of type *metrics.EndpointMetricsAggregated
+// Exit codes of run and coordinator. Go errors exit with 1 through log.Fatal.
+const (
+	exitChecksFailed    = 2 // at least one check failed
+	exitStoppedByScript = 3 // the script called accelira.stop()
+	exitWorkerLost      = 4 // a worker disconnected before finishing
+)
 
-			metrics1[key] = map[string]interface{}{
-				// Uncomment if ResponseTimesTDigest is available
-				// "50thPercentileLatency": value.ResponseTimesTDigest.Quantile(0.5),
-				// "90thPercentileLatency": value.ResponseTimesTDigest.Quantile(0.9),
+// workersLost is set by the coordinator when a worker disconnected before
+// sending its final results.
+var workersLost bool
 
-				// Use ResponseTimes if it's a valid time.Duration
-				"realtimeResponse": value.ResponseTimesTDigest.Quantile(95),
-			}
+// countRequests sums the HTTP requests of a worker's snapshot.
+func countRequests(metricsMap map[string]*metrics.EndpointMetricsAggregated) int {
+	requests := 0
+	for _, aggregated := range metricsMap {
+		if aggregated.Type == metrics.HTTPRequest {
+			requests += aggregated.TotalRequests
 		}
+	}
+	return requests
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(metrics1); err != nil {
-			http.Error(w, "Failed to encode metrics", http.StatusInternalServerError)
+// exitCode tells CI whether the test passed: 0 if it ran to the end and every
+// check passed.
+func exitCode() int {
+	if vmhandler.StopReason() != "" {
+		return exitStoppedByScript
+	}
+	if workersLost {
+		return exitWorkerLost
+	}
+	for _, aggregated := range metricsprocessor.MetricsMap {
+		if aggregated.Type == metrics.Error && aggregated.TotalCheckFailed > 0 {
+			return exitChecksFailed
 		}
-	})
+	}
+	return 0
+}
+
+// startDashboard serves the live dashboard, which is fed as an output so it
+// sees every collected metric.
+func startDashboard(cmd *cobra.Command) *dashboard.Dashboard {
+	interval, _ := cmd.Flags().GetDuration("dashboard-interval")
+	liveDashboard := dashboard.New(interval)
+	go func() {
+		log.Println(liveDashboard.ListenAndServe(":8080"))
+	}()
+	fmt.Println("Dashboard running at http://localhost:8080")
+	return liveDashboard
+}
 
-	// Log the dashboard URL and start the server
-	log.Println("Dashboard running at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+func checkError(message string, err error) {
+	if err != nil {
+		log.Fatalf("%s: %v", message, err)
+	}
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Every module provided through require() must be left to the runtime instead
+// of being resolved by the bundler.
+func TestBuildJavaScriptCodeKeepsBuiltInModulesExternal(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "test.js")
+	content := `import data from "Accelira/data";
+const http = require("Accelira/http");
+const users = data.openJSON("./users.json");
+export default function () { http.get(users[0].url); }
+`
+	if err := os.WriteFile(script, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := buildJavaScriptCode(script)
+	if err != nil {
+		t.Fatalf("expected the script to bundle, got %v", err)
+	}
+	for _, module := range []string{"Accelira/data", "Accelira/http"} {
+		if !strings.Contains(code, `require("`+module+`")`) {
+			t.Errorf("expected the bundle to require %q, got:\n%s", module, code)
+		}
+	}
+}
@@ -2,25 +2,77 @@
 package metrics
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/influxdata/tdigest"
 )
 
+// recordingPaused is non-zero while metrics are discarded, e.g. during warm-up.
+var recordingPaused int32
+
+// PauseRecording discards all metrics sent until ResumeRecording is called.
+func PauseRecording() {
+	atomic.StoreInt32(&recordingPaused, 1)
+}
+
+// ResumeRecording starts recording metrics again.
+func ResumeRecording() {
+	atomic.StoreInt32(&recordingPaused, 0)
+}
+
+// IsRecording reports whether sent metrics are currently recorded.
+func IsRecording() bool {
+	return atomic.LoadInt32(&recordingPaused) == 0
+}
+
+// SendMetrics queues metrics for aggregation. They are discarded while
+// recording is paused or when metricsChan is nil.
 func SendMetrics(metrics Metrics, metricsChan chan<- Metrics) {
+	if !IsRecording() || metricsChan == nil {
+		return
+	}
+
 	select {
 	case metricsChan <- metrics:
 	default:
-		fmt.Println("Channel is full, dropping metrics")
+		atomic.AddInt64(&droppedMetrics, 1)
 	}
 }
 
+// droppedMetrics counts metrics dropped because the metrics channel was full.
+var droppedMetrics int64
+
+// DroppedMetrics returns the number of metrics dropped so far.
+func DroppedMetrics() int64 {
+	return atomic.LoadInt64(&droppedMetrics)
+}
+
+// runTags are the tags given with --tag, attached to every metric of the run.
+// They're set before the run starts and only read afterwards.
+var runTags map[string]string
+
+// SetRunTags attaches tags to every metric of the run. Tags a request sets
+// itself through params.tags take precedence.
+func SetRunTags(tags map[string]string) {
+	runTags = tags
+}
+
+// RunTags returns the tags attached to every metric of the run.
+func RunTags() map[string]string {
+	return runTags
+}
+
 func NewTDigest() *tdigest.TDigest {
 	return tdigest.New()
 }
 
-func CollectGroupMetrics(name string, duration time.Duration) Metrics {
+// CollectGroupMetrics reports one run of a group together with the requests,
+// errors and bytes of the requests made inside it.
+func CollectGroupMetrics(name string, duration time.Duration, requests, errors, bytesReceived, bytesSent int) Metrics {
 	key := fmt.Sprintf("group: %s", name)
 	epMetrics := &EndpointMetrics{
 		URL:              name,
@@ -28,6 +80,10 @@ func CollectGroupMetrics(name string, duration time.Duration) Metrics {
 		StatusCodeCounts: make(map[int]int),
 		ResponseTime:     0,
 		Type:             Group,
+		ChildRequests:    requests,
+		Errors:           errors,
+		BytesReceived:    bytesReceived,
+		BytesSent:        bytesSent,
 	}
 
 	epMetrics.ResponseTime = duration
@@ -35,6 +91,58 @@ func CollectGroupMetrics(name string, duration time.Duration) Metrics {
 	return Metrics{EndpointMetricsMap: map[string]*EndpointMetrics{key: epMetrics}}
 }
 
+// IterationsKey is the key iterations are aggregated under, with their
+// durations as the response times.
+const IterationsKey = "iteration_duration"
+
+// CollectIterationMetrics reports one completed iteration of a VU and its wall
+// time, the end-to-end latency of the scenario.
+func CollectIterationMetrics(duration time.Duration) Metrics {
+	epMetrics := &EndpointMetrics{
+		URL:          IterationsKey,
+		Method:       "ITERATION",
+		Type:         Iteration,
+		ResponseTime: duration,
+	}
+
+	return Metrics{EndpointMetricsMap: map[string]*EndpointMetrics{IterationsKey: epMetrics}}
+}
+
+// DroppedIterationsKey is the key iterations dropped at the concurrency limit
+// are counted under.
+const DroppedIterationsKey = "dropped_iterations"
+
+// CollectDroppedIterationMetrics reports an iteration that was due to start
+// but dropped because the concurrency limit was reached, i.e. load that was
+// shed rather than generated.
+func CollectDroppedIterationMetrics() Metrics {
+	epMetrics := &EndpointMetrics{
+		URL:    DroppedIterationsKey,
+		Method: "DROPPED",
+		Type:   DroppedIteration,
+	}
+
+	return Metrics{EndpointMetricsMap: map[string]*EndpointMetrics{DroppedIterationsKey: epMetrics}}
+}
+
+// SchedulingDelayKey is the key scheduling delays are aggregated under, with
+// the delays as the response times.
+const SchedulingDelayKey = "scheduling_delay"
+
+// CollectSchedulingDelayMetrics reports how long after its scheduled start an
+// iteration of the arrival rate actually started. A growing delay means the
+// load generator, not the server, is falling behind.
+func CollectSchedulingDelayMetrics(delay time.Duration) Metrics {
+	epMetrics := &EndpointMetrics{
+		URL:          SchedulingDelayKey,
+		Method:       "SCHEDULING",
+		Type:         SchedulingDelay,
+		ResponseTime: delay,
+	}
+
+	return Metrics{EndpointMetricsMap: map[string]*EndpointMetrics{SchedulingDelayKey: epMetrics}}
+}
+
 func CollectErrorMetrics(name string, result bool) Metrics {
 	key := name
 	epMetrics := &EndpointMetrics{
@@ -57,6 +165,10 @@ const (
 	HTTPRequest MetricType = "HTTP_REQUEST"
 	Error       MetricType = "ERROR"
 	Group       MetricType = "GROUP"
+	Iteration   MetricType = "ITERATION"
+
+	SchedulingDelay  MetricType = "SCHEDULING_DELAY"
+	DroppedIteration MetricType = "DROPPED_ITERATION"
 )
 
 // type EndpointMetrics struct {
@@ -92,6 +204,7 @@ type EndpointMetrics struct {
 	TCPHandshakeLatency time.Duration
 	DNSLookupLatency    time.Duration
 	TLSHandshakeLatency time.Duration
+	TTFB                time.Duration
 	BodySendLatency     time.Duration
 	BodyReceiveLatency  time.Duration
 	CheckResult         bool
@@ -99,20 +212,232 @@ type EndpointMetrics struct {
 	BytesReceived       int
 	BytesSent           int
 	Errors              int
+	Aborted             int               // requests cancelled by a hard stop
+	NotModified         int               // 304 responses to conditional requests
+	InFlight            int               // requests in flight to the endpoint when this one started, including itself
+	RemoteIP            string            // address of the server that answered
+	ChildRequests       int               // requests made inside a group run
+	RateLimited         int               // 429 responses, or 503 with Retry-After
+	Tags                map[string]string // tags of the request, from params.tags
+	TLSVersion          string            // TLS version negotiated by the handshake, if the request made one
+	TLSCipherSuite      string            // cipher suite negotiated by the handshake, if the request made one
+	RedirectChain       int               // redirects received before the redirect limit stopped the request, 0 if it didn't
+	ClientErrors        int               // 4xx responses
+	ServerErrors        int               // 5xx responses
+	TransportErrors     int               // requests that got no response, e.g. refused connections or timeouts
+	Unsampled           bool              // latencies left out of the digests by the metrics sample rate
+	ConnectTimeouts     int               // requests that timed out establishing a connection
+	ResponseTimeouts    int               // requests that connected but timed out waiting for the response
 }
 
 type EndpointMetricsAggregated struct {
 	StatusCodeCounts           map[int]int
+	RemoteIPCounts             map[string]int
+	TLSVersionCounts           map[string]int `json:",omitempty"` // handshakes per negotiated TLS version
+	TLSCipherSuiteCounts       map[string]int `json:",omitempty"` // handshakes per negotiated cipher suite
 	TotalRequests              int
 	TotalResponseTime          time.Duration
-	ResponseTimesTDigest       *tdigest.TDigest
+	SumSquaredResponseTime     float64          // sum of squared response times in ms², for the standard deviation
+	ResponseTimesTDigest       *tdigest.TDigest `json:"-"`
 	TotalBytesReceived         int
 	TotalBytesSent             int
 	TotalErrors                int
-	TCPHandshakeLatencyTDigest *tdigest.TDigest
-	DNSLookupLatencyTDigest    *tdigest.TDigest
-	TLSHandshakeLatencyTDigest *tdigest.TDigest
+	TotalAborted               int
+	TotalNotModified           int
+	MaxInFlight                int
+	TotalChildRequests         int
+	TotalRateLimited           int
+	TotalTooManyRedirects      int               // requests stopped by the redirect limit
+	MaxRedirectChain           int               // longest redirect chain stopped by the limit
+	TotalClientErrors          int               // 4xx responses
+	TotalServerErrors          int               // 5xx responses
+	TotalTransportErrors       int               // requests that got no response
+	TotalConnectTimeouts       int               // requests that timed out establishing a connection
+	TotalResponseTimeouts      int               // requests that timed out waiting for the response
+	Tags                       map[string]string `json:",omitempty"` // tags of the endpoint's requests
+	TimeSeries                 []*EndpointBucket `json:",omitempty"` // requests per time bucket, for the latency trend
+	TCPHandshakeLatencyTDigest *tdigest.TDigest  `json:"-"`
+	DNSLookupLatencyTDigest    *tdigest.TDigest  `json:"-"`
+	TLSHandshakeLatencyTDigest *tdigest.TDigest  `json:"-"`
+	TTFBTDigest                *tdigest.TDigest  `json:"-"`
+	BodyReceiveLatencyTDigest  *tdigest.TDigest  `json:"-"`
 	TotalCheckPassed           int
 	TotalCheckFailed           int
 	Type                       MetricType
 }
+
+// AddTags adds tags the aggregate doesn't have yet. The first value seen for
+// a tag is kept.
+func (m *EndpointMetricsAggregated) AddTags(tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	if m.Tags == nil {
+		m.Tags = make(map[string]string, len(tags))
+	}
+	for name, value := range tags {
+		if _, ok := m.Tags[name]; !ok {
+			m.Tags[name] = value
+		}
+	}
+}
+
+// AddTLSHandshake counts the version and cipher suite negotiated by a
+// request's TLS handshake. Requests that reused a connection or didn't use
+// TLS aren't counted.
+func (m *EndpointMetricsAggregated) AddTLSHandshake(version, cipherSuite string, count int) {
+	if version == "" {
+		return
+	}
+	if m.TLSVersionCounts == nil {
+		m.TLSVersionCounts = make(map[string]int)
+		m.TLSCipherSuiteCounts = make(map[string]int)
+	}
+	m.TLSVersionCounts[version] += count
+	m.TLSCipherSuiteCounts[cipherSuite] += count
+}
+
+// AddRedirectChain counts a request the redirect limit stopped after the given
+// number of redirects; 0 means the request wasn't stopped.
+func (m *EndpointMetricsAggregated) AddRedirectChain(redirects int) {
+	if redirects == 0 {
+		return
+	}
+	m.TotalTooManyRedirects++
+	if redirects > m.MaxRedirectChain {
+		m.MaxRedirectChain = redirects
+	}
+}
+
+// HasTags reports whether the aggregate has all of the given tags.
+func (m *EndpointMetricsAggregated) HasTags(tags map[string]string) bool {
+	for name, value := range tags {
+		if m.Tags[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ResponseTimeSpread returns the mean and standard deviation of the response
+// time and their ratio, the coefficient of variation.
+func (m *EndpointMetricsAggregated) ResponseTimeSpread() (mean, stdDev time.Duration, coefficientOfVariation float64) {
+	if m.TotalRequests == 0 {
+		return 0, 0, 0
+	}
+	count := float64(m.TotalRequests)
+	meanMs := float64(m.TotalResponseTime) / float64(time.Millisecond) / count
+	variance := m.SumSquaredResponseTime/count - meanMs*meanMs
+	if variance < 0 {
+		// Rounding, or results exported before the sum of squares was kept.
+		variance = 0
+	}
+	stdDevMs := math.Sqrt(variance)
+	if meanMs > 0 {
+		coefficientOfVariation = stdDevMs / meanMs
+	}
+	return time.Duration(meanMs * float64(time.Millisecond)), time.Duration(stdDevMs * float64(time.Millisecond)), coefficientOfVariation
+}
+
+// Digests returns the t-digests of the aggregate keyed by a stable name, so
+// they can be serialized and merged generically.
+func (m *EndpointMetricsAggregated) Digests() map[string]**tdigest.TDigest {
+	return map[string]**tdigest.TDigest{
+		"responseTimes":       &m.ResponseTimesTDigest,
+		"tcpHandshakeLatency": &m.TCPHandshakeLatencyTDigest,
+		"dnsLookupLatency":    &m.DNSLookupLatencyTDigest,
+		"tlsHandshakeLatency": &m.TLSHandshakeLatencyTDigest,
+		"ttfb":                &m.TTFBTDigest,
+		"bodyReceiveLatency":  &m.BodyReceiveLatencyTDigest,
+	}
+}
+
+// endpointMetricsAggregatedFields has the fields of EndpointMetricsAggregated
+// without its JSON methods.
+type endpointMetricsAggregatedFields EndpointMetricsAggregated
+
+// endpointMetricsAggregatedJSON is the serialized form of an aggregate, with
+// each t-digest stored as its centroids.
+type endpointMetricsAggregatedJSON struct {
+	*endpointMetricsAggregatedFields
+	Digests map[string]tdigest.CentroidList
+}
+
+// MarshalJSON encodes the aggregate including its t-digest centroids.
+func (m *EndpointMetricsAggregated) MarshalJSON() ([]byte, error) {
+	digests := make(map[string]tdigest.CentroidList)
+	for name, digest := range m.Digests() {
+		if *digest != nil {
+			digests[name] = (*digest).Centroids()
+		}
+	}
+
+	return json.Marshal(endpointMetricsAggregatedJSON{
+		endpointMetricsAggregatedFields: (*endpointMetricsAggregatedFields)(m),
+		Digests:                         digests,
+	})
+}
+
+// UnmarshalJSON decodes an aggregate, rebuilding its t-digests from centroids.
+func (m *EndpointMetricsAggregated) UnmarshalJSON(data []byte) error {
+	decoded := endpointMetricsAggregatedJSON{endpointMetricsAggregatedFields: (*endpointMetricsAggregatedFields)(m)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	for name, digest := range m.Digests() {
+		*digest = tdigest.New()
+		if centroids, ok := decoded.Digests[name]; ok {
+			(*digest).AddCentroidList(centroids)
+		}
+	}
+	return nil
+}
+
+// TimeBucket aggregates the HTTP requests completed within one interval of a
+// run, so latency can be followed over time.
+type TimeBucket struct {
+	Start                time.Time
+	Requests             int
+	Errors               int
+	ResponseTimesTDigest *tdigest.TDigest `json:"-"`
+}
+
+// EndpointBucket holds the requests of one endpoint completed within one
+// interval of the time series; enough to follow its latency trend.
+type EndpointBucket struct {
+	Start             time.Time
+	Requests          int
+	Errors            int
+	TotalResponseTime time.Duration
+}
+
+// timeBucketFields has the fields of TimeBucket without its JSON methods.
+type timeBucketFields TimeBucket
+
+// timeBucketJSON is the serialized form of a bucket, with its t-digest stored
+// as its centroids.
+type timeBucketJSON struct {
+	*timeBucketFields
+	ResponseTimes tdigest.CentroidList
+}
+
+// MarshalJSON encodes the bucket including its t-digest centroids.
+func (b *TimeBucket) MarshalJSON() ([]byte, error) {
+	var centroids tdigest.CentroidList
+	if b.ResponseTimesTDigest != nil {
+		centroids = b.ResponseTimesTDigest.Centroids()
+	}
+	return json.Marshal(timeBucketJSON{timeBucketFields: (*timeBucketFields)(b), ResponseTimes: centroids})
+}
+
+// UnmarshalJSON decodes a bucket, rebuilding its t-digest from centroids.
+func (b *TimeBucket) UnmarshalJSON(data []byte) error {
+	decoded := timeBucketJSON{timeBucketFields: (*timeBucketFields)(b)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	b.ResponseTimesTDigest = tdigest.New()
+	b.ResponseTimesTDigest.AddCentroidList(decoded.ResponseTimes)
+	return nil
+}
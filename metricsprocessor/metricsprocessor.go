@@ -1,8 +1,11 @@
 package metricsprocessor
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/accelira/accelira/metrics"
 	"github.com/influxdata/tdigest"
@@ -12,13 +15,33 @@ var (
 	MetricsMap      = make(map[string]*metrics.EndpointMetricsAggregated)
 	MetricsMapMutex sync.RWMutex
 	MetricsReceived int32
+
+	// MaxEndpointKeys caps the number of distinct keys in MetricsMap; once it is
+	// reached, new keys are grouped into an "other" bucket per metric type.
+	// 0 means no limit.
+	MaxEndpointKeys int
+
+	// TimeSeries holds HTTP requests bucketed by the wall-clock interval in
+	// which they completed. 0 for TimeSeriesInterval disables bucketing.
+	TimeSeries         []*metrics.TimeBucket
+	TimeSeriesInterval = 10 * time.Second
 )
 
-func GatherMetrics(metricsChannel <-chan metrics.Metrics, metricsWaitGroup *sync.WaitGroup) {
+// overflowKey is the key samples are grouped under once MaxEndpointKeys is reached.
+func overflowKey(metricType metrics.MetricType) string {
+	return fmt.Sprintf("other (%s, endpoint limit reached)", metricType)
+}
+
+// GatherMetrics aggregates metrics from the channel into MetricsMap until it is
+// closed, passing each metric to the handlers as well.
+func GatherMetrics(metricsChannel <-chan metrics.Metrics, metricsWaitGroup *sync.WaitGroup, handlers ...func(metrics.Metrics)) {
 	defer metricsWaitGroup.Done()
 
 	for metric := range metricsChannel {
 		processMetrics(metric)
+		for _, handle := range handlers {
+			handle(metric)
+		}
 	}
 }
 
@@ -29,21 +52,118 @@ func processMetrics(metric metrics.Metrics) {
 }
 
 func processEndpointMetric(key string, endpointMetric *metrics.EndpointMetrics) {
+	now := time.Now()
+	// Requests cut off by a hard stop only have a partial duration, so they
+	// count as aborted without adding to the requests or latencies.
+	aborted := endpointMetric.Aborted > 0
+	if endpointMetric.Type == metrics.HTTPRequest && !aborted {
+		addToTimeSeries(now, endpointMetric)
+	}
+
 	// MetricsMapMutex.RLock()
 	storedMetric, isExisting := MetricsMap[key]
 	// MetricsMapMutex.RUnlock()
 
 	// fmt.Printf("storedMetric %v \n", storedMetric)
 
+	if !isExisting && !isRunWideMetric(endpointMetric.Type) && MaxEndpointKeys > 0 && len(MetricsMap) >= MaxEndpointKeys {
+		key = overflowKey(endpointMetric.Type)
+		storedMetric, isExisting = MetricsMap[key]
+	}
+
+	if aborted {
+		if !isExisting {
+			storedMetric = newAbortedMetric(endpointMetric)
+			MetricsMap[key] = storedMetric
+		} else {
+			storedMetric.TotalAborted += endpointMetric.Aborted
+			storedMetric.AddTags(endpointMetric.Tags)
+		}
+		return
+	}
+
 	if !isExisting {
-		newMetric := initializeNewMetric(endpointMetric)
+		storedMetric = initializeNewMetric(endpointMetric)
 		// MetricsMapMutex.Lock()
-		MetricsMap[key] = newMetric
+		MetricsMap[key] = storedMetric
 		// MetricsMapMutex.Unlock()
+	} else {
+		mergeMetrics(storedMetric, endpointMetric)
+	}
+
+	if endpointMetric.Type == metrics.HTTPRequest {
+		addToEndpointTimeSeries(storedMetric, now, endpointMetric)
+	}
+}
+
+// isRunWideMetric reports whether metrics of a type are kept under one fixed
+// key for the whole run, so they never count against MaxEndpointKeys.
+func isRunWideMetric(metricType metrics.MetricType) bool {
+	switch metricType {
+	case metrics.Iteration, metrics.SchedulingDelay, metrics.DroppedIteration:
+		return true
+	}
+	return false
+}
+
+// addToTimeSeries adds a request to the bucket for the interval containing now,
+// starting a new bucket when the interval has moved on.
+func addToTimeSeries(now time.Time, endpointMetric *metrics.EndpointMetrics) {
+	if TimeSeriesInterval <= 0 {
 		return
 	}
 
-	mergeMetrics(storedMetric, endpointMetric)
+	start := now.Truncate(TimeSeriesInterval)
+	if len(TimeSeries) == 0 || TimeSeries[len(TimeSeries)-1].Start.Before(start) {
+		TimeSeries = append(TimeSeries, &metrics.TimeBucket{Start: start, ResponseTimesTDigest: tdigest.New()})
+	}
+
+	bucket := TimeSeries[len(TimeSeries)-1]
+	bucket.Requests++
+	bucket.Errors += endpointMetric.Errors
+	if !endpointMetric.Unsampled {
+		bucket.ResponseTimesTDigest.Add(float64(endpointMetric.ResponseTime.Milliseconds()), 1)
+	}
+}
+
+// addToEndpointTimeSeries adds a request to the endpoint's bucket for the
+// interval containing now.
+func addToEndpointTimeSeries(storedMetric *metrics.EndpointMetricsAggregated, now time.Time, endpointMetric *metrics.EndpointMetrics) {
+	if TimeSeriesInterval <= 0 {
+		return
+	}
+
+	start := now.Truncate(TimeSeriesInterval)
+	timeSeries := storedMetric.TimeSeries
+	if len(timeSeries) == 0 || timeSeries[len(timeSeries)-1].Start.Before(start) {
+		storedMetric.TimeSeries = append(timeSeries, &metrics.EndpointBucket{Start: start})
+	}
+
+	bucket := storedMetric.TimeSeries[len(storedMetric.TimeSeries)-1]
+	bucket.Requests++
+	bucket.Errors += endpointMetric.Errors
+	bucket.TotalResponseTime += endpointMetric.ResponseTime
+}
+
+// mergeEndpointTimeSeries merges two endpoint time series by bucket start.
+func mergeEndpointTimeSeries(stored, other []*metrics.EndpointBucket) []*metrics.EndpointBucket {
+	// Keyed by UnixNano, as decoded times differ from local ones in location
+	byStart := make(map[int64]*metrics.EndpointBucket, len(stored))
+	for _, bucket := range stored {
+		byStart[bucket.Start.UnixNano()] = bucket
+	}
+	for _, bucket := range other {
+		if storedBucket, ok := byStart[bucket.Start.UnixNano()]; ok {
+			storedBucket.Requests += bucket.Requests
+			storedBucket.Errors += bucket.Errors
+			storedBucket.TotalResponseTime += bucket.TotalResponseTime
+			continue
+		}
+		stored = append(stored, bucket)
+		byStart[bucket.Start.UnixNano()] = bucket
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Start.Before(stored[j].Start) })
+	return stored
 }
 
 func initializeNewMetric(endpointMetric *metrics.EndpointMetrics) *metrics.EndpointMetricsAggregated {
@@ -52,19 +172,43 @@ func initializeNewMetric(endpointMetric *metrics.EndpointMetrics) *metrics.Endpo
 		TCPHandshakeLatencyTDigest: tdigest.New(),
 		DNSLookupLatencyTDigest:    tdigest.New(),
 		TLSHandshakeLatencyTDigest: tdigest.New(),
+		TTFBTDigest:                tdigest.New(),
+		BodyReceiveLatencyTDigest:  tdigest.New(),
 		TotalRequests:              1,
 		TotalResponseTime:          endpointMetric.ResponseTime,
+		SumSquaredResponseTime:     squaredMilliseconds(endpointMetric.ResponseTime),
 		TotalBytesReceived:         endpointMetric.BytesReceived,
 		TotalBytesSent:             endpointMetric.BytesSent,
 		TotalErrors:                endpointMetric.Errors,
+		TotalAborted:               endpointMetric.Aborted,
+		TotalNotModified:           endpointMetric.NotModified,
+		MaxInFlight:                endpointMetric.InFlight,
+		TotalChildRequests:         endpointMetric.ChildRequests,
+		TotalRateLimited:           endpointMetric.RateLimited,
+		TotalClientErrors:          endpointMetric.ClientErrors,
+		TotalServerErrors:          endpointMetric.ServerErrors,
+		TotalTransportErrors:       endpointMetric.TransportErrors,
+		TotalConnectTimeouts:       endpointMetric.ConnectTimeouts,
+		TotalResponseTimeouts:      endpointMetric.ResponseTimeouts,
 		StatusCodeCounts:           make(map[int]int),
+		RemoteIPCounts:             make(map[string]int),
 		Type:                       endpointMetric.Type,
 	}
 
+	if endpointMetric.RemoteIP != "" {
+		returnMetrics.RemoteIPCounts[endpointMetric.RemoteIP] = 1
+	}
+	returnMetrics.AddRedirectChain(endpointMetric.RedirectChain)
+	returnMetrics.AddTLSHandshake(endpointMetric.TLSVersion, endpointMetric.TLSCipherSuite, 1)
+	returnMetrics.AddTags(endpointMetric.Tags)
+	returnMetrics.AddTags(metrics.RunTags())
+
 	returnMetrics.ResponseTimesTDigest.Add(float64(endpointMetric.ResponseTime.Milliseconds()), 1)
 	returnMetrics.TCPHandshakeLatencyTDigest.Add(float64(endpointMetric.TCPHandshakeLatency.Milliseconds()), 1)
 	returnMetrics.DNSLookupLatencyTDigest.Add(float64(endpointMetric.DNSLookupLatency.Milliseconds()), 1)
 	returnMetrics.TLSHandshakeLatencyTDigest.Add(float64(endpointMetric.TLSHandshakeLatency.Milliseconds()), 1)
+	returnMetrics.TTFBTDigest.Add(float64(endpointMetric.TTFB.Milliseconds()), 1)
+	returnMetrics.BodyReceiveLatencyTDigest.Add(float64(endpointMetric.BodyReceiveLatency.Milliseconds()), 1)
 	if endpointMetric.CheckResult {
 		returnMetrics.TotalCheckPassed += 1
 	} else {
@@ -74,14 +218,55 @@ func initializeNewMetric(endpointMetric *metrics.EndpointMetrics) *metrics.Endpo
 	return returnMetrics
 }
 
+// newAbortedMetric starts the aggregate of an endpoint whose first request
+// was aborted, with no requests or latencies yet.
+func newAbortedMetric(endpointMetric *metrics.EndpointMetrics) *metrics.EndpointMetricsAggregated {
+	returnMetrics := &metrics.EndpointMetricsAggregated{
+		ResponseTimesTDigest:       tdigest.New(),
+		TCPHandshakeLatencyTDigest: tdigest.New(),
+		DNSLookupLatencyTDigest:    tdigest.New(),
+		TLSHandshakeLatencyTDigest: tdigest.New(),
+		TTFBTDigest:                tdigest.New(),
+		BodyReceiveLatencyTDigest:  tdigest.New(),
+		TotalAborted:               endpointMetric.Aborted,
+		StatusCodeCounts:           make(map[int]int),
+		RemoteIPCounts:             make(map[string]int),
+		Type:                       endpointMetric.Type,
+	}
+	returnMetrics.AddTags(endpointMetric.Tags)
+	returnMetrics.AddTags(metrics.RunTags())
+	return returnMetrics
+}
+
+// squaredMilliseconds returns d² in ms², accumulated for the standard deviation,
+// which t-digests can't provide.
+func squaredMilliseconds(d time.Duration) float64 {
+	ms := float64(d) / float64(time.Millisecond)
+	return ms * ms
+}
+
 func mergeMetrics(storedMetric *metrics.EndpointMetricsAggregated, newMetric *metrics.EndpointMetrics) {
 	atomic.AddInt32(&MetricsReceived, 1)
 
 	storedMetric.TotalRequests += 1
 	storedMetric.TotalResponseTime += newMetric.ResponseTime
+	storedMetric.SumSquaredResponseTime += squaredMilliseconds(newMetric.ResponseTime)
 	storedMetric.TotalBytesReceived += newMetric.BytesReceived
 	storedMetric.TotalBytesSent += newMetric.BytesSent
 	storedMetric.TotalErrors += newMetric.Errors
+	storedMetric.TotalAborted += newMetric.Aborted
+	storedMetric.TotalNotModified += newMetric.NotModified
+	storedMetric.TotalChildRequests += newMetric.ChildRequests
+	storedMetric.TotalRateLimited += newMetric.RateLimited
+	storedMetric.TotalClientErrors += newMetric.ClientErrors
+	storedMetric.TotalServerErrors += newMetric.ServerErrors
+	storedMetric.TotalTransportErrors += newMetric.TransportErrors
+	storedMetric.TotalConnectTimeouts += newMetric.ConnectTimeouts
+	storedMetric.TotalResponseTimeouts += newMetric.ResponseTimeouts
+	storedMetric.AddRedirectChain(newMetric.RedirectChain)
+	if newMetric.InFlight > storedMetric.MaxInFlight {
+		storedMetric.MaxInFlight = newMetric.InFlight
+	}
 	if newMetric.CheckResult {
 		storedMetric.TotalCheckPassed += 1
 	} else {
@@ -91,8 +276,16 @@ func mergeMetrics(storedMetric *metrics.EndpointMetricsAggregated, newMetric *me
 	for statusCode, count := range newMetric.StatusCodeCounts {
 		storedMetric.StatusCodeCounts[statusCode] += count
 	}
+	if newMetric.RemoteIP != "" {
+		storedMetric.RemoteIPCounts[newMetric.RemoteIP]++
+	}
+	storedMetric.AddTLSHandshake(newMetric.TLSVersion, newMetric.TLSCipherSuite, 1)
+	storedMetric.AddTags(newMetric.Tags)
 
-	mergeTDigests(storedMetric, newMetric)
+	// Counts always add up; only the costly digest updates are sampled.
+	if !newMetric.Unsampled {
+		mergeTDigests(storedMetric, newMetric)
+	}
 }
 
 func mergeTDigests(storedMetric *metrics.EndpointMetricsAggregated, newMetric *metrics.EndpointMetrics) {
@@ -106,4 +299,88 @@ func mergeTDigests(storedMetric *metrics.EndpointMetricsAggregated, newMetric *m
 	if newMetric.TLSHandshakeLatency.Milliseconds() > 0 {
 		storedMetric.TLSHandshakeLatencyTDigest.Add(float64(newMetric.TLSHandshakeLatency.Milliseconds()), 1)
 	}
+	if newMetric.TTFB.Milliseconds() > 0 {
+		storedMetric.TTFBTDigest.Add(float64(newMetric.TTFB.Milliseconds()), 1)
+	}
+	if newMetric.BodyReceiveLatency.Milliseconds() > 0 {
+		storedMetric.BodyReceiveLatencyTDigest.Add(float64(newMetric.BodyReceiveLatency.Milliseconds()), 1)
+	}
+}
+
+// MergeAggregated merges an aggregate produced elsewhere (e.g. by a remote
+// worker) into MetricsMap, summing counts and merging t-digests.
+func MergeAggregated(key string, aggregated *metrics.EndpointMetricsAggregated) {
+	MetricsMapMutex.Lock()
+	defer MetricsMapMutex.Unlock()
+
+	storedMetric, isExisting := MetricsMap[key]
+	if !isExisting {
+		aggregated.AddTags(metrics.RunTags())
+		MetricsMap[key] = aggregated
+		return
+	}
+
+	storedMetric.TotalRequests += aggregated.TotalRequests
+	storedMetric.TotalResponseTime += aggregated.TotalResponseTime
+	storedMetric.SumSquaredResponseTime += aggregated.SumSquaredResponseTime
+	storedMetric.TotalBytesReceived += aggregated.TotalBytesReceived
+	storedMetric.TotalBytesSent += aggregated.TotalBytesSent
+	storedMetric.TotalErrors += aggregated.TotalErrors
+	storedMetric.TotalAborted += aggregated.TotalAborted
+	storedMetric.TotalNotModified += aggregated.TotalNotModified
+	storedMetric.TotalChildRequests += aggregated.TotalChildRequests
+	storedMetric.TotalRateLimited += aggregated.TotalRateLimited
+	storedMetric.TotalTooManyRedirects += aggregated.TotalTooManyRedirects
+	storedMetric.TotalClientErrors += aggregated.TotalClientErrors
+	storedMetric.TotalServerErrors += aggregated.TotalServerErrors
+	storedMetric.TotalTransportErrors += aggregated.TotalTransportErrors
+	storedMetric.TotalConnectTimeouts += aggregated.TotalConnectTimeouts
+	storedMetric.TotalResponseTimeouts += aggregated.TotalResponseTimeouts
+	if aggregated.MaxRedirectChain > storedMetric.MaxRedirectChain {
+		storedMetric.MaxRedirectChain = aggregated.MaxRedirectChain
+	}
+	storedMetric.TotalCheckPassed += aggregated.TotalCheckPassed
+	storedMetric.TotalCheckFailed += aggregated.TotalCheckFailed
+	if aggregated.MaxInFlight > storedMetric.MaxInFlight {
+		storedMetric.MaxInFlight = aggregated.MaxInFlight
+	}
+
+	if storedMetric.StatusCodeCounts == nil {
+		storedMetric.StatusCodeCounts = make(map[int]int)
+	}
+	for statusCode, count := range aggregated.StatusCodeCounts {
+		storedMetric.StatusCodeCounts[statusCode] += count
+	}
+
+	if storedMetric.RemoteIPCounts == nil {
+		storedMetric.RemoteIPCounts = make(map[string]int)
+	}
+	for remoteIP, count := range aggregated.RemoteIPCounts {
+		storedMetric.RemoteIPCounts[remoteIP] += count
+	}
+	for version, count := range aggregated.TLSVersionCounts {
+		if storedMetric.TLSVersionCounts == nil {
+			storedMetric.TLSVersionCounts = make(map[string]int)
+		}
+		storedMetric.TLSVersionCounts[version] += count
+	}
+	for cipherSuite, count := range aggregated.TLSCipherSuiteCounts {
+		if storedMetric.TLSCipherSuiteCounts == nil {
+			storedMetric.TLSCipherSuiteCounts = make(map[string]int)
+		}
+		storedMetric.TLSCipherSuiteCounts[cipherSuite] += count
+	}
+	storedMetric.AddTags(aggregated.Tags)
+	storedMetric.TimeSeries = mergeEndpointTimeSeries(storedMetric.TimeSeries, aggregated.TimeSeries)
+
+	storedDigests := storedMetric.Digests()
+	for name, digest := range aggregated.Digests() {
+		if *digest == nil {
+			continue
+		}
+		if *storedDigests[name] == nil {
+			*storedDigests[name] = tdigest.New()
+		}
+		(*storedDigests[name]).AddCentroidList((*digest).Centroids())
+	}
 }
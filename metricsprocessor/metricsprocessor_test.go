@@ -0,0 +1,83 @@
+package metricsprocessor
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/accelira/accelira/metrics"
+)
+
+// Aggregates survive a JSON round trip and merge counts and digests
+func TestMergeAggregatedAfterJSONRoundTrip(t *testing.T) {
+	MetricsMap = make(map[string]*metrics.EndpointMetricsAggregated)
+
+	worker := initializeNewMetric(&metrics.EndpointMetrics{Type: metrics.HTTPRequest, ResponseTime: 100e6, Errors: 1})
+	worker.StatusCodeCounts[200] = 1
+
+	data, err := json.Marshal(map[string]*metrics.EndpointMetricsAggregated{"GET /": worker})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var decoded map[string]*metrics.EndpointMetricsAggregated
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	MergeAggregated("GET /", decoded["GET /"])
+	MergeAggregated("GET /", initializeNewMetric(&metrics.EndpointMetrics{Type: metrics.HTTPRequest, ResponseTime: 300e6}))
+
+	merged := MetricsMap["GET /"]
+	if merged.TotalRequests != 2 || merged.TotalErrors != 1 {
+		t.Fatalf("expected 2 requests and 1 error, got %d and %d", merged.TotalRequests, merged.TotalErrors)
+	}
+	if merged.StatusCodeCounts[200] != 1 {
+		t.Fatalf("expected status code counts to survive, got %v", merged.StatusCodeCounts)
+	}
+	if count := merged.ResponseTimesTDigest.Count(); count != 2 {
+		t.Fatalf("expected 2 samples in the merged digest, got %v", count)
+	}
+	if max := merged.ResponseTimesTDigest.Quantile(1); max != 300 {
+		t.Fatalf("expected max response time 300ms, got %v", max)
+	}
+}
+
+// Mean, standard deviation and coefficient of variation come from the running sums
+func TestResponseTimeSpread(t *testing.T) {
+	MetricsMap = make(map[string]*metrics.EndpointMetricsAggregated)
+
+	processEndpointMetric("GET /", &metrics.EndpointMetrics{Type: metrics.HTTPRequest, ResponseTime: 100e6})
+	processEndpointMetric("GET /", &metrics.EndpointMetrics{Type: metrics.HTTPRequest, ResponseTime: 300e6})
+
+	mean, stdDev, coefficientOfVariation := MetricsMap["GET /"].ResponseTimeSpread()
+	if mean != 200e6 || stdDev != 100e6 {
+		t.Fatalf("expected mean 200ms and stddev 100ms, got %v and %v", mean, stdDev)
+	}
+	if coefficientOfVariation != 0.5 {
+		t.Fatalf("expected coefficient of variation 0.5, got %v", coefficientOfVariation)
+	}
+}
+
+// Aborted requests only count as aborted, leaving the request count and
+// latencies to the requests that completed
+func TestAbortedRequestsStayOutOfLatencies(t *testing.T) {
+	MetricsMap = make(map[string]*metrics.EndpointMetricsAggregated)
+
+	processEndpointMetric("GET /slow", &metrics.EndpointMetrics{Type: metrics.HTTPRequest, ResponseTime: 5e6, Aborted: 1})
+	processEndpointMetric("GET /slow", &metrics.EndpointMetrics{Type: metrics.HTTPRequest, ResponseTime: 400e6})
+	processEndpointMetric("GET /slow", &metrics.EndpointMetrics{Type: metrics.HTTPRequest, ResponseTime: 10e6, Aborted: 1})
+
+	slow := MetricsMap["GET /slow"]
+	if slow.TotalRequests != 1 || slow.TotalAborted != 2 {
+		t.Fatalf("expected 1 request and 2 aborted, got %d and %d", slow.TotalRequests, slow.TotalAborted)
+	}
+	if slow.TotalResponseTime != 400e6 {
+		t.Fatalf("expected 400ms total response time, got %v", slow.TotalResponseTime)
+	}
+	if count := slow.ResponseTimesTDigest.Count(); count != 1 {
+		t.Fatalf("expected 1 sample in the digest, got %v", count)
+	}
+	if min := slow.ResponseTimesTDigest.Quantile(0); min != 400 {
+		t.Fatalf("expected min response time 400ms, got %v", min)
+	}
+}
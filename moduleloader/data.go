@@ -0,0 +1,130 @@
+package moduleloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dop251/goja"
+)
+
+// dataFormats are the parsers of the data file formats, by name.
+var dataFormats = map[string]func([]byte) ([]json.RawMessage, error){
+	"json":   parseJSONArray,
+	"ndjson": parseNDJSON,
+}
+
+// sharedData holds the records of data files by format and path. Files are
+// read once and shared by every VU; each VM only wraps the records.
+var (
+	sharedData      = make(map[string][]json.RawMessage)
+	sharedDataMutex sync.Mutex
+)
+
+// createDataModule loads test data files. Relative paths are resolved against
+// the script's directory.
+func createDataModule(config *Config, vm *goja.Runtime) map[string]interface{} {
+	open := func(format, path string) (goja.Value, error) {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(config.ScriptDir, path)
+		}
+		records, err := loadSharedData(format, path)
+		if err != nil {
+			return nil, err
+		}
+		return vm.NewDynamicArray(&dataArray{vm: vm, records: records}), nil
+	}
+
+	return map[string]interface{}{
+		"openJSON": func(path string) (goja.Value, error) {
+			return open("json", path)
+		},
+		"openNDJSON": func(path string) (goja.Value, error) {
+			return open("ndjson", path)
+		},
+	}
+}
+
+// loadSharedData returns the records of a file, reading it on first use.
+func loadSharedData(format, path string) ([]json.RawMessage, error) {
+	sharedDataMutex.Lock()
+	defer sharedDataMutex.Unlock()
+
+	key := format + " " + path
+	if records, ok := sharedData[key]; ok {
+		return records, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records, err := dataFormats[format](content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	sharedData[key] = records
+	return records, nil
+}
+
+// parseJSONArray splits a JSON array into its elements.
+func parseJSONArray(content []byte) ([]json.RawMessage, error) {
+	var records []json.RawMessage
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// parseNDJSON splits newline-delimited JSON into its records, skipping blank
+// lines.
+func parseNDJSON(content []byte) ([]json.RawMessage, error) {
+	var records []json.RawMessage
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), len(content)+1)
+	for line := 1; scanner.Scan(); line++ {
+		record := bytes.TrimSpace(scanner.Bytes())
+		if len(record) == 0 {
+			continue
+		}
+		if !json.Valid(record) {
+			return nil, fmt.Errorf("line %d is not valid JSON", line)
+		}
+		records = append(records, json.RawMessage(append([]byte(nil), record...)))
+	}
+	return records, scanner.Err()
+}
+
+// dataArray exposes shared records as a read-only JS array. Each access
+// decodes a fresh copy, so a VU changing a record can't affect the others.
+type dataArray struct {
+	vm      *goja.Runtime
+	records []json.RawMessage
+}
+
+func (a *dataArray) Len() int {
+	return len(a.records)
+}
+
+func (a *dataArray) Get(index int) goja.Value {
+	if index < 0 || index >= len(a.records) {
+		return goja.Undefined()
+	}
+	var record interface{}
+	if err := json.Unmarshal(a.records[index], &record); err != nil {
+		panic(a.vm.NewGoError(err))
+	}
+	return a.vm.ToValue(record)
+}
+
+func (a *dataArray) Set(index int, value goja.Value) bool {
+	return false
+}
+
+func (a *dataArray) SetLen(length int) bool {
+	return false
+}
@@ -0,0 +1,325 @@
+package moduleloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// sharedSchemas holds the JSON schemas loaded by check.jsonSchema by path.
+// Schemas are read once and shared by every VU; validation never modifies
+// them.
+var (
+	sharedSchemas      = make(map[string]*jsonSchema)
+	sharedSchemasMutex sync.Mutex
+)
+
+// jsonSchema is a parsed JSON Schema document. It supports the validation
+// keywords contract tests commonly use: type, enum, const, the numeric, string
+// and array bounds, pattern, properties, required, additionalProperties,
+// items, allOf, anyOf, oneOf, not and local $refs into the document.
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// loadSharedSchema returns the schema at path, reading it on first use.
+func loadSharedSchema(path string) (*jsonSchema, error) {
+	sharedSchemasMutex.Lock()
+	defer sharedSchemasMutex.Unlock()
+
+	if schema, ok := sharedSchemas[path]; ok {
+		return schema, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := parseJSONSchema(content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing schema %s: %w", path, err)
+	}
+	sharedSchemas[path] = schema
+	return schema, nil
+}
+
+// parseJSONSchema parses a schema document, compiling its patterns up front
+// so a bad pattern is reported on load rather than per response.
+func parseJSONSchema(content []byte) (*jsonSchema, error) {
+	schema := &jsonSchema{patterns: make(map[string]*regexp.Regexp)}
+	if err := json.Unmarshal(content, &schema.root); err != nil {
+		return nil, err
+	}
+	if err := schema.compilePatterns(schema.root); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (s *jsonSchema) compilePatterns(node interface{}) error {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		if pattern, ok := node["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			s.patterns[pattern] = re
+		}
+		for _, child := range node {
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range node {
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate returns the ways value violates the schema, each prefixed with the
+// JSON path of the offending value; none if it is valid.
+func (s *jsonSchema) Validate(value interface{}) []string {
+	return s.validate(s.root, value, "$")
+}
+
+func (s *jsonSchema) validate(node, value interface{}, path string) []string {
+	switch node := node.(type) {
+	case bool:
+		// true accepts everything, false nothing.
+		if !node {
+			return []string{fmt.Sprintf("%s: not allowed", path)}
+		}
+		return nil
+	case map[string]interface{}:
+		return s.validateObject(node, value, path)
+	default:
+		return nil
+	}
+}
+
+func (s *jsonSchema) validateObject(node map[string]interface{}, value interface{}, path string) []string {
+	if ref, ok := node["$ref"].(string); ok {
+		target, err := s.resolveRef(ref)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %v", path, err)}
+		}
+		return s.validate(target, value, path)
+	}
+
+	var violations []string
+	fail := func(format string, args ...interface{}) {
+		violations = append(violations, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if types, ok := node["type"]; ok && !matchesType(types, value) {
+		fail("expected %s, got %s", typeNames(types), jsonTypeName(value))
+		return violations
+	}
+	if enum, ok := node["enum"].([]interface{}); ok && !containsJSON(enum, value) {
+		fail("%s is not one of the allowed values", compactJSON(value))
+	}
+	if constant, ok := node["const"]; ok && !reflect.DeepEqual(constant, value) {
+		fail("expected %s, got %s", compactJSON(constant), compactJSON(value))
+	}
+
+	switch value := value.(type) {
+	case float64:
+		if min, ok := node["minimum"].(float64); ok && value < min {
+			fail("%v is less than the minimum of %v", value, min)
+		}
+		if max, ok := node["maximum"].(float64); ok && value > max {
+			fail("%v is greater than the maximum of %v", value, max)
+		}
+		if min, ok := node["exclusiveMinimum"].(float64); ok && value <= min {
+			fail("%v is not greater than %v", value, min)
+		}
+		if max, ok := node["exclusiveMaximum"].(float64); ok && value >= max {
+			fail("%v is not less than %v", value, max)
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(value))
+		if min, ok := node["minLength"].(float64); ok && length < min {
+			fail("string is shorter than %v characters", min)
+		}
+		if max, ok := node["maxLength"].(float64); ok && length > max {
+			fail("string is longer than %v characters", max)
+		}
+		if pattern, ok := node["pattern"].(string); ok && !s.patterns[pattern].MatchString(value) {
+			fail("%q doesn't match the pattern %q", value, pattern)
+		}
+	case []interface{}:
+		if min, ok := node["minItems"].(float64); ok && float64(len(value)) < min {
+			fail("array has fewer than %v items", min)
+		}
+		if max, ok := node["maxItems"].(float64); ok && float64(len(value)) > max {
+			fail("array has more than %v items", max)
+		}
+		if items, ok := node["items"]; ok {
+			for i, item := range value {
+				violations = append(violations, s.validate(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := node["required"].([]interface{}); ok {
+			for _, name := range required {
+				if name, ok := name.(string); ok {
+					if _, present := value[name]; !present {
+						fail("missing required property %q", name)
+					}
+				}
+			}
+		}
+		properties, _ := node["properties"].(map[string]interface{})
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propertyPath := path + "." + name
+			if property, ok := properties[name]; ok {
+				violations = append(violations, s.validate(property, value[name], propertyPath)...)
+			} else if additional, ok := node["additionalProperties"]; ok {
+				if allowed, isBool := additional.(bool); isBool && !allowed {
+					fail("unexpected property %q", name)
+				} else {
+					violations = append(violations, s.validate(additional, value[name], propertyPath)...)
+				}
+			}
+		}
+	}
+
+	if allOf, ok := node["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			violations = append(violations, s.validate(sub, value, path)...)
+		}
+	}
+	if anyOf, ok := node["anyOf"].([]interface{}); ok && s.countMatches(anyOf, value, path) == 0 {
+		fail("doesn't match any of the anyOf schemas")
+	}
+	if oneOf, ok := node["oneOf"].([]interface{}); ok {
+		if matches := s.countMatches(oneOf, value, path); matches != 1 {
+			fail("matches %d of the oneOf schemas instead of exactly one", matches)
+		}
+	}
+	if not, ok := node["not"]; ok && len(s.validate(not, value, path)) == 0 {
+		fail("matches a schema it must not match")
+	}
+	return violations
+}
+
+// countMatches returns how many of the schemas value is valid against.
+func (s *jsonSchema) countMatches(schemas []interface{}, value interface{}, path string) int {
+	matches := 0
+	for _, sub := range schemas {
+		if len(s.validate(sub, value, path)) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+// resolveRef resolves a JSON pointer into the schema document, e.g.
+// #/definitions/user or #/$defs/user. References to other documents aren't
+// supported.
+func (s *jsonSchema) resolveRef(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q, only references within the schema are supported", ref)
+	}
+	node := s.root
+	for _, token := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if node, ok = object[token]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+// matchesType reports whether value has the type, or one of the types, the
+// type keyword allows.
+func matchesType(types interface{}, value interface{}) bool {
+	switch types := types.(type) {
+	case string:
+		return isJSONType(types, value)
+	case []interface{}:
+		for _, name := range types {
+			if name, ok := name.(string); ok && isJSONType(name, value) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func isJSONType(name string, value interface{}) bool {
+	if name == "integer" {
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	}
+	return name == jsonTypeName(value)
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func typeNames(types interface{}) string {
+	if list, ok := types.([]interface{}); ok {
+		names := make([]string, len(list))
+		for i, name := range list {
+			names[i] = fmt.Sprint(name)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(types)
+}
+
+func containsJSON(values []interface{}, value interface{}) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compactJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
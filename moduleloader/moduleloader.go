@@ -2,28 +2,106 @@
 package moduleloader
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/hmac"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/accelira/accelira/httpclient"
 	"github.com/accelira/accelira/metrics" // Import the new metrics package
 	"github.com/accelira/accelira/util"
 	"github.com/dop251/goja"
+	"github.com/fatih/color"
 	"github.com/golang-jwt/jwt/v4"
 )
 
 type Config struct {
-	Iterations      int
-	RampUpRate      int
-	ConcurrentUsers int
-	Duration        time.Duration
+	Iterations          int
+	RampUpRate          int
+	ConcurrentUsers     int
+	Duration            time.Duration
+	Warmup              time.Duration
+	GracefulStop        time.Duration     // time iterations may run past Duration before being cut off
+	MaxRequests         int               // total requests across all VUs, 0 for no limit
+	ConditionalRequests bool              // revalidate URLs with If-None-Match/If-Modified-Since
+	VURate              float64           // iterations per second allowed per VU, 0 for no limit
+	ScriptDir           string            // base directory for resolving relative require() calls
+	TraceRequests       bool              // log the httptrace breakdown for sampled requests
+	TraceSampleRate     float64           // fraction of requests traced when TraceRequests is set
+	MetricsBufferSize   int               // metrics channel capacity, 0 for ConcurrentUsers*5
+	HostResolve         map[string]string // "host:port" to the "ip:port" to connect to instead
+	NoKeepAlive         bool              // open a new connection for every request
+	IterationTimeout    time.Duration     // iterations running longer are interrupted, 0 for no limit
+	Exec                string            // exported function each iteration runs, empty for the default export
+	SharedIterations    int               // total iterations shared by all VUs, 0 for no limit
+	MaxIterationsPerVM  int               // iterations after which a VU gets a fresh VM, 0 to never recycle
+	Environments        Environments      // variables per target environment, by name
+	Env                 string            // selected environment, exposed via __ENV
+	SummaryPercentiles  []string          // latency percentiles in the report, e.g. "p99"; empty for p90 and p95
+	MaxRetries          int               // retries of 429 (or 503 with Retry-After) responses, honoring Retry-After
+	URLList             []URLTarget       // requests sampled by weight when the script has no default export
+	UserAgent           string            // User-Agent of every request, empty for the default
+	ExpectedStatus      []string          // statuses counted as successful, e.g. "200", "200-299" or "2xx"; empty for any
+	RateStages          []RateStage       // iteration arrival rates ramped through in order; empty to iterate as fast as VUs can
+	MaxConcurrent       int               // requests in flight across all VUs, 0 for no limit
+	MaxConcurrentPolicy string            // "wait" to queue requests over MaxConcurrent, "drop" to also drop iterations starting at the limit
+	TraceHeaders        bool              // attach a generated X-Request-ID and W3C traceparent to every request
+	Seed                int64             // seed of Math.random and sleep.jitter, offset per VU; 0 for a random seed
+	DNSCache            bool              // resolve each host once and reuse its addresses across VUs
+	DNSCacheTTL         time.Duration     // how long cached addresses are reused, 0 for the whole run
+	MaxRedirects        int               // redirects a request may follow, 0 for the default of 10, negative for none
+	NoTLSResumption     bool              // make a full TLS handshake on every new connection instead of resuming a session
+	MetricsSampleRate   float64           // fraction of requests whose latencies go into the percentiles, 0 for all
+	ConnectTimeout      time.Duration     // how long establishing a connection may take, 0 for the default of 30s
 }
 
+// RateStage ramps the iteration arrival rate linearly to Target iterations per
+// second over Duration, starting from the previous stage's target.
+type RateStage struct {
+	Duration time.Duration
+	Target   float64
+}
+
+// URLTarget is a request of the URL list, picked with a probability
+// proportional to its weight.
+type URLTarget struct {
+	URL    string
+	Method string
+	Weight float64
+}
+
+// Environments maps an environment name to the variables exposed via __ENV
+// when it is selected.
+type Environments map[string]map[string]interface{}
+
 func createConfigModule(config *Config) map[string]interface{} {
 	return map[string]interface{}{
 		"setIterations":      func(iterations int) { config.Iterations = iterations },
@@ -32,133 +110,1131 @@ func createConfigModule(config *Config) map[string]interface{} {
 		"getIterations":      func() int { return config.Iterations },
 		"getRampUpRate":      func() int { return config.RampUpRate },
 		"getConcurrentUsers": func() int { return config.ConcurrentUsers },
+		"setVUs":             func(users int) { config.ConcurrentUsers = users },
+		"getVUs":             func() int { return config.ConcurrentUsers },
+		"getPlan":            func() map[string]interface{} { return executionPlan(config) },
 		"setDuration": func(duration string) {
 			parsedDuration, _ := time.ParseDuration(duration)
 			config.Duration = parsedDuration
 		},
 		"getDuration": func() time.Duration { return config.Duration },
+		"setWarmup": func(duration string) {
+			parsedDuration, _ := time.ParseDuration(duration)
+			config.Warmup = parsedDuration
+		},
+		"getWarmup": func() time.Duration { return config.Warmup },
+		"setGracefulStop": func(duration string) error {
+			parsedDuration, err := time.ParseDuration(duration)
+			if err != nil || parsedDuration < 0 {
+				return fmt.Errorf("invalid graceful stop %q, expected a duration such as \"30s\", or \"0s\" to stop at once", duration)
+			}
+			config.GracefulStop = parsedDuration
+			return nil
+		},
+		"getGracefulStop":        func() time.Duration { return config.GracefulStop },
+		"setMaxRequests":         func(maxRequests int) { config.MaxRequests = maxRequests },
+		"getMaxRequests":         func() int { return config.MaxRequests },
+		"setConditionalRequests": func(enabled bool) { config.ConditionalRequests = enabled },
+		"getConditionalRequests": func() bool { return config.ConditionalRequests },
+		"setVURate":              func(rate float64) { config.VURate = rate },
+		"getVURate":              func() float64 { return config.VURate },
+		"setHostResolve":         func(hostResolve map[string]string) { config.HostResolve = hostResolve },
+		"getHostResolve":         func() map[string]string { return config.HostResolve },
+		"setNoKeepAlive":         func(disabled bool) { config.NoKeepAlive = disabled },
+		"getNoKeepAlive":         func() bool { return config.NoKeepAlive },
+		"setIterationTimeout": func(duration string) error {
+			parsedDuration, err := time.ParseDuration(duration)
+			if err != nil || parsedDuration < 0 {
+				return fmt.Errorf("invalid iteration timeout %q, expected a duration such as \"10s\", or \"0s\" for no limit", duration)
+			}
+			config.IterationTimeout = parsedDuration
+			return nil
+		},
+		"getIterationTimeout":   func() time.Duration { return config.IterationTimeout },
+		"setExec":               func(exec string) { config.Exec = exec },
+		"getExec":               func() string { return config.Exec },
+		"setSharedIterations":   func(iterations int) { config.SharedIterations = iterations },
+		"getSharedIterations":   func() int { return config.SharedIterations },
+		"setMaxIterationsPerVM": func(iterations int) { config.MaxIterationsPerVM = iterations },
+		"getMaxIterationsPerVM": func() int { return config.MaxIterationsPerVM },
+		"setEnvironments":       func(environments Environments) { config.Environments = environments },
+		"getEnvironments":       func() Environments { return config.Environments },
+		"getEnv":                func() string { return config.Env },
+		"setSummaryPercentiles": func(percentiles []string) { config.SummaryPercentiles = percentiles },
+		"getSummaryPercentiles": func() []string { return config.SummaryPercentiles },
+		"setMaxRetries":         func(retries int) { config.MaxRetries = retries },
+		"getMaxRetries":         func() int { return config.MaxRetries },
+		"setURLList": func(targets []map[string]interface{}) error {
+			urlList, err := parseURLList(targets)
+			if err != nil {
+				return err
+			}
+			config.URLList = urlList
+			return nil
+		},
+		"getURLList":   func() []URLTarget { return config.URLList },
+		"setUserAgent": func(userAgent string) { config.UserAgent = userAgent },
+		"getUserAgent": func() string { return config.UserAgent },
+		"setExpectedStatus": func(statuses []interface{}) error {
+			expectedStatus, err := parseExpectedStatus(statuses)
+			if err != nil {
+				return err
+			}
+			config.ExpectedStatus = expectedStatus
+			return nil
+		},
+		"getExpectedStatus": func() []string { return config.ExpectedStatus },
+		"setRateStages": func(stages []map[string]interface{}) error {
+			rateStages, err := parseRateStages(stages)
+			if err != nil {
+				return err
+			}
+			config.RateStages = rateStages
+			return nil
+		},
+		"getRateStages":    func() []RateStage { return config.RateStages },
+		"setMaxConcurrent": func(maxConcurrent int) { config.MaxConcurrent = maxConcurrent },
+		"getMaxConcurrent": func() int { return config.MaxConcurrent },
+		"setMaxConcurrentPolicy": func(policy string) error {
+			if policy != "wait" && policy != "drop" {
+				return fmt.Errorf("invalid max concurrent policy %q, expected \"wait\" or \"drop\"", policy)
+			}
+			config.MaxConcurrentPolicy = policy
+			return nil
+		},
+		"getMaxConcurrentPolicy": func() string { return config.MaxConcurrentPolicy },
+		"setTraceHeaders":        func(enabled bool) { config.TraceHeaders = enabled },
+		"getTraceHeaders":        func() bool { return config.TraceHeaders },
+		"setSeed":                func(seed int64) { config.Seed = seed },
+		"getSeed":                func() int64 { return config.Seed },
+		"setDNSCache":            func(enabled bool) { config.DNSCache = enabled },
+		"getDNSCache":            func() bool { return config.DNSCache },
+		"setDNSCacheTTL": func(duration string) error {
+			parsedDuration, err := time.ParseDuration(duration)
+			if err != nil || parsedDuration < 0 {
+				return fmt.Errorf("invalid DNS cache TTL %q, expected a duration such as \"30s\", or \"0s\" for the whole run", duration)
+			}
+			config.DNSCacheTTL = parsedDuration
+			return nil
+		},
+		"getDNSCacheTTL": func() time.Duration { return config.DNSCacheTTL },
+		"setMaxRedirects": func(max int) error {
+			if max < 0 {
+				return fmt.Errorf("invalid max redirects %d, expected 0 or more", max)
+			}
+			// 0 returns redirect responses as they are; the zero value
+			// keeps the default.
+			if max == 0 {
+				max = -1
+			}
+			config.MaxRedirects = max
+			return nil
+		},
+		"getMaxRedirects": func() int {
+			switch {
+			case config.MaxRedirects == 0:
+				return httpclient.DefaultMaxRedirects
+			case config.MaxRedirects < 0:
+				return 0
+			}
+			return config.MaxRedirects
+		},
+		"setTLSSessionResumption": func(enabled bool) { config.NoTLSResumption = !enabled },
+		"getTLSSessionResumption": func() bool { return !config.NoTLSResumption },
+		"setMetricsSampleRate": func(rate float64) error {
+			if rate <= 0 || rate > 1 {
+				return fmt.Errorf("invalid metrics sample rate %v, expected more than 0 and at most 1", rate)
+			}
+			config.MetricsSampleRate = rate
+			return nil
+		},
+		"getMetricsSampleRate": func() float64 {
+			if config.MetricsSampleRate == 0 {
+				return 1
+			}
+			return config.MetricsSampleRate
+		},
+		"setConnectTimeout": func(duration string) error {
+			parsedDuration, err := time.ParseDuration(duration)
+			if err != nil || parsedDuration <= 0 {
+				return fmt.Errorf("invalid connect timeout %q, expected a positive duration such as \"2s\"", duration)
+			}
+			config.ConnectTimeout = parsedDuration
+			return nil
+		},
+		"getConnectTimeout": func() time.Duration {
+			if config.ConnectTimeout == 0 {
+				return httpclient.DefaultConnectTimeout
+			}
+			return config.ConnectTimeout
+		},
 	}
 }
 
-func SetupRequire(vm *goja.Runtime, config *Config, metricsChan chan<- metrics.Metrics) func(moduleName string) interface{} {
-	return func(moduleName string) interface{} {
-		switch moduleName {
-		case "Accelira/http":
-			return createHTTPModule(metricsChan)
-		case "Accelira/config":
-			return createConfigModule(config)
-		case "Accelira/group":
-			return createGroupModule(metricsChan)
-		case "Accelira/assert":
-			return createAssertModule(metricsChan, vm) // Pass vm here
-		case "fs":
-			return createFSModule()
-		case "crypto":
-			return createCryptoModule()
-		case "jsonwebtoken":
-			return createJsonWebTokenModule()
+// parseURLList converts the {url, weight, method} entries given to
+// config.setURLList. Method defaults to GET and weight to 1.
+func parseURLList(entries []map[string]interface{}) ([]URLTarget, error) {
+	targets := make([]URLTarget, len(entries))
+	for i, entry := range entries {
+		target := URLTarget{Method: "GET", Weight: 1}
+		target.URL, _ = entry["url"].(string)
+		if target.URL == "" {
+			return nil, fmt.Errorf("URL list entry %d has no url", i)
 		}
-		return nil
+		if method, ok := entry["method"].(string); ok && method != "" {
+			target.Method = strings.ToUpper(method)
+		}
+		if value, ok := entry["weight"]; ok {
+			weight, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("URL list entry %d has an invalid weight %v", i, value)
+			}
+			target.Weight = weight
+		}
+		targets[i] = target
+	}
+	return targets, nil
+}
+
+// parseRateStages converts the {duration, target} stages given to
+// config.setRateStages.
+func parseRateStages(entries []map[string]interface{}) ([]RateStage, error) {
+	stages := make([]RateStage, len(entries))
+	for i, entry := range entries {
+		duration, err := time.ParseDuration(fmt.Sprint(entry["duration"]))
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("rate stage %d has an invalid duration %v", i, entry["duration"])
+		}
+		target, err := strconv.ParseFloat(fmt.Sprint(entry["target"]), 64)
+		if err != nil || target < 0 {
+			return nil, fmt.Errorf("rate stage %d has an invalid target %v", i, entry["target"])
+		}
+		stages[i] = RateStage{Duration: duration, Target: target}
 	}
+	return stages, nil
+}
+
+// parseExpectedStatus converts the status codes, ranges and classes given to
+// config.setExpectedStatus, rejecting invalid ones.
+func parseExpectedStatus(statuses []interface{}) ([]string, error) {
+	specs := make([]string, len(statuses))
+	for i, status := range statuses {
+		specs[i] = fmt.Sprint(status)
+		if _, err := httpclient.ParseStatusRange(specs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return specs, nil
+}
+
+// ApplyConfigValues calls the config setter for each value, matching keys to
+// setter names case-insensitively, e.g. {"vus": 10, "duration": "1m"} calls
+// setVUs(10) and setDuration("1m").
+func ApplyConfigValues(config *Config, values map[string]interface{}) error {
+	vm := goja.New()
+	setters := make(map[string]goja.Callable)
+	for name, fn := range createConfigModule(config) {
+		if strings.HasPrefix(name, "set") {
+			setter, _ := goja.AssertFunction(vm.ToValue(fn))
+			setters[strings.ToLower(strings.TrimPrefix(name, "set"))] = setter
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		setter, ok := setters[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown config option %q", name)
+		}
+		if _, err := setter(goja.Undefined(), vm.ToValue(values[name])); err != nil {
+			// Report the setter's own error rather than the JS exception around it
+			if cause := errors.Unwrap(err); cause != nil {
+				err = cause
+			}
+			return fmt.Errorf("invalid value for %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// EnvironmentVariables returns the value of __ENV: the process environment,
+// overlaid with the variables of the selected environment.
+func EnvironmentVariables(config *Config) map[string]interface{} {
+	variables := make(map[string]interface{})
+	for _, entry := range os.Environ() {
+		if name, value, ok := strings.Cut(entry, "="); ok {
+			variables[name] = value
+		}
+	}
+	for name, value := range config.Environments[config.Env] {
+		variables[name] = value
+	}
+	return variables
+}
+
+// executionPlan describes how the test will run, for scripts to log or inspect.
+func executionPlan(config *Config) map[string]interface{} {
+	return map[string]interface{}{
+		"vus":              config.ConcurrentUsers,
+		"rampUpRate":       config.RampUpRate,
+		"duration":         config.Duration.String(),
+		"warmup":           config.Warmup.String(),
+		"gracefulStop":     config.GracefulStop.String(),
+		"iterationTimeout": config.IterationTimeout.String(),
+		"sharedIterations": config.SharedIterations,
+		"maxRequests":      config.MaxRequests,
+		"rate":             config.VURate,
+		"rateStages":       len(config.RateStages),
+		"maxConcurrent":    config.MaxConcurrent,
+		"exec":             config.Exec,
+	}
+}
+
+func SetupRequire(vm *goja.Runtime, config *Config, metricsChan chan<- metrics.Metrics) func(moduleName string) (interface{}, error) {
+	cache := make(map[string]goja.Value)
+	groups := &groupScope{}
+	hooks := &requestHooks{}
+
+	var requireFrom func(dir string) func(moduleName string) (interface{}, error)
+	requireFrom = func(dir string) func(moduleName string) (interface{}, error) {
+		return func(moduleName string) (interface{}, error) {
+			switch moduleName {
+			case "Accelira/http":
+				return createHTTPModule(config, metricsChan, vm, groups, hooks), nil
+			case "Accelira/config":
+				return createConfigModule(config), nil
+			case "Accelira/group":
+				return createGroupModule(metricsChan, groups), nil
+			case "Accelira/assert":
+				return createAssertModule(config, metricsChan, vm), nil // Pass vm here
+			case "Accelira/data":
+				return createDataModule(config, vm), nil
+			case "fs":
+				return createFSModule(), nil
+			case "crypto":
+				return createCryptoModule(), nil
+			case "jsonwebtoken":
+				return createJsonWebTokenModule(), nil
+			}
+			if isLocalModule(moduleName) {
+				return loadLocalModule(vm, dir, moduleName, cache, requireFrom)
+			}
+			return nil, nil
+		}
+	}
+
+	return requireFrom(config.ScriptDir)
+}
+
+// isLocalModule reports whether the module name refers to a file on disk.
+func isLocalModule(moduleName string) bool {
+	return strings.HasPrefix(moduleName, "./") || strings.HasPrefix(moduleName, "../") || filepath.IsAbs(moduleName)
+}
+
+// resolveLocalModule finds the file for a local module, trying the exact path,
+// a ".js" suffix and an index.js inside a directory, in that order.
+func resolveLocalModule(dir, moduleName string) (string, error) {
+	path := moduleName
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, moduleName)
+	}
+
+	for _, candidate := range []string{path, path + ".js", filepath.Join(path, "index.js")} {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("cannot find module '%s'", moduleName)
+}
+
+// loadLocalModule evaluates a local CommonJS file and returns its exports.
+// Modules are cached per VM, and nested requires resolve relative to the
+// requiring file, mirroring Node's behaviour.
+func loadLocalModule(vm *goja.Runtime, dir, moduleName string, cache map[string]goja.Value, requireFrom func(dir string) func(moduleName string) (interface{}, error)) (interface{}, error) {
+	path, err := resolveLocalModule(dir, moduleName)
+	if err != nil {
+		return nil, err
+	}
+
+	if exports, ok := cache[path]; ok {
+		return exports, nil
+	}
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading module '%s': %w", moduleName, err)
+	}
+
+	wrapper, err := vm.RunScript(path, "(function(module, exports, require) {"+string(source)+"\n})")
+	if err != nil {
+		return nil, fmt.Errorf("error compiling module '%s': %w", moduleName, err)
+	}
+	fn, ok := goja.AssertFunction(wrapper)
+	if !ok {
+		return nil, fmt.Errorf("error loading module '%s'", moduleName)
+	}
+
+	module := vm.NewObject()
+	exports := vm.NewObject()
+	module.Set("exports", exports)
+	// Cache the partial exports first so circular requires terminate.
+	cache[path] = exports
+
+	if _, err := fn(goja.Undefined(), module, exports, vm.ToValue(requireFrom(filepath.Dir(path)))); err != nil {
+		delete(cache, path)
+		return nil, fmt.Errorf("error executing module '%s': %w", moduleName, err)
+	}
+
+	cache[path] = module.Get("exports")
+	return cache[path], nil
 }
 
 // createHTTPModule handles HTTP requests (GET, POST, PUT, DELETE) and sends metrics.
-func createHTTPModule(metricsChan chan<- metrics.Metrics) map[string]interface{} {
-	client := httpclient.NewHTTPClient()
+// Each method takes an optional params object; params.checks is run against
+// the response like assert.check.
+func createHTTPModule(config *Config, metricsChan chan<- metrics.Metrics, vm *goja.Runtime, groups *groupScope, hooks *requestHooks) map[string]interface{} {
+	client := httpclient.NewHTTPClient(httpclient.ClientOptions{
+		TraceRequests:       config.TraceRequests,
+		TraceSampleRate:     config.TraceSampleRate,
+		MaxRequests:         config.MaxRequests,
+		ConditionalRequests: config.ConditionalRequests,
+		HostResolve:         config.HostResolve,
+		NoKeepAlive:         config.NoKeepAlive,
+		MaxRetries:          config.MaxRetries,
+		UserAgent:           config.UserAgent,
+		ExpectedStatus:      expectedStatusRanges(config.ExpectedStatus),
+		TraceHeaders:        config.TraceHeaders,
+		DNSCache:            config.DNSCache,
+		DNSCacheTTL:         config.DNSCacheTTL,
+		MaxRedirects:        config.MaxRedirects,
+		NoTLSResumption:     config.NoTLSResumption,
+		MetricsSampleRate:   config.MetricsSampleRate,
+		ConnectTimeout:      config.ConnectTimeout,
+		Seed:                config.Seed,
+	})
+	// prepare reads everything a request needs from the VM, so the request
+	// itself can then be sent from any goroutine.
+	prepare := func(url, method string, body io.Reader, headers http.Header, params *goja.Object) *pendingRequest {
+		request := &pendingRequest{url: url, method: method, headers: headers, params: params}
+		if body != nil {
+			data, err := io.ReadAll(body)
+			if err != nil {
+				panic(vm.NewGoError(err))
+			}
+			request.bodyText = string(data)
+			request.body = strings.NewReader(request.bodyText)
+		}
+		request.recorded = recordsMetrics(params)
+		request.options = httpclient.RequestOptions{
+			Tags:      requestTags(params),
+			NoMetrics: !request.recorded,
+			Compress:  requestCompression(vm, params),
+		}
+		request.options.Trace, request.traceCallback = requestTrace(params)
+		return request
+	}
+	perform := func(request *pendingRequest) {
+		request.resp, request.err = client.DoRequestWithOptions(request.url, request.method, request.body, request.headers, request.options, metricsChan)
+	}
+	// finish wraps the response of a sent request, which keeps the request
+	// under res.request so http.replay can send it again.
+	finish := func(request *pendingRequest) map[string]interface{} {
+		if request.recorded {
+			groups.record(request.resp)
+		}
+		responseObject := createResponseObject(vm, request.resp, request.err, metricsChan)
+		responseObject["request"] = map[string]interface{}{
+			"method":  request.method,
+			"url":     request.url,
+			"headers": headersObject(request.headers),
+			"body":    request.bodyText,
+		}
+		if request.options.Trace {
+			responseObject["trace"] = traceEventsObject(request.resp.TraceEvents)
+			if request.traceCallback != nil {
+				if _, err := request.traceCallback(goja.Undefined(), vm.ToValue(responseObject["trace"])); err != nil {
+					panic(err)
+				}
+			}
+		}
+		runRequestChecks(vm, responseObject, request.params, metricsChan)
+		hooks.afterResponse(vm, responseObject)
+		return responseObject
+	}
+	// dispatch sends a request as is and wraps the response.
+	dispatch := func(url, method string, body io.Reader, headers http.Header, params *goja.Object) map[string]interface{} {
+		request := prepare(url, method, body, headers, params)
+		perform(request)
+		return finish(request)
+	}
+	send := func(url, method string, body io.Reader, headers http.Header, params *goja.Object) map[string]interface{} {
+		headers = requestHeaders(vm, headers, params)
+		url, body, headers = hooks.beforeRequest(vm, url, method, body, headers)
+		return dispatch(url, method, body, headers, params)
+	}
+
 	return map[string]interface{}{
-		"get": func(url string) map[string]interface{} {
-			resp, err := client.DoRequest(url, "GET", nil, metricsChan)
-			return createResponseObject(resp, err, metricsChan)
+		"get": func(url string, params *goja.Object) map[string]interface{} {
+			return send(url, "GET", nil, nil, params)
 		},
-		"post": func(url string, body string) map[string]interface{} {
-			resp, err := client.DoRequest(url, "POST", strings.NewReader(body), metricsChan)
-			return createResponseObject(resp, err, metricsChan)
+		"post": func(url string, body goja.Value, params *goja.Object) map[string]interface{} {
+			requestBody, headers := encodeRequestBody(vm, body)
+			return send(url, "POST", requestBody, headers, params)
 		},
-		"put": func(url string, body string) map[string]interface{} {
-			resp, err := client.DoRequest(url, "PUT", strings.NewReader(body), metricsChan)
-			return createResponseObject(resp, err, metricsChan)
+		"put": func(url string, body goja.Value, params *goja.Object) map[string]interface{} {
+			requestBody, headers := encodeRequestBody(vm, body)
+			return send(url, "PUT", requestBody, headers, params)
 		},
-		"delete": func(url string) map[string]interface{} {
-			resp, err := client.DoRequest(url, "DELETE", nil, metricsChan)
-			return createResponseObject(resp, err, metricsChan)
+		"patch": func(url string, body goja.Value, params *goja.Object) map[string]interface{} {
+			requestBody, headers := encodeRequestBody(vm, body)
+			return send(url, "PATCH", requestBody, headers, params)
 		},
+		"delete": func(url string, body goja.Value, params *goja.Object) map[string]interface{} {
+			requestBody, headers := encodeRequestBody(vm, body)
+			return send(url, "DELETE", requestBody, headers, params)
+		},
+		// replay sends the request of an earlier response again exactly as it
+		// was sent, e.g. to test that a POST with an idempotency key isn't
+		// applied twice. Hooks don't run again.
+		"replay": func(response *goja.Object, params *goja.Object) map[string]interface{} {
+			url, method, body, headers := replayedRequest(vm, response)
+			return dispatch(url, method, body, headers, params)
+		},
+		// batch sends several requests in parallel and returns their responses
+		// in order once all have completed. Each entry is a URL to GET or a
+		// { method, url, body, params } object.
+		"batch": func(entries []goja.Value) []map[string]interface{} {
+			requests := make([]*pendingRequest, len(entries))
+			for i, entry := range entries {
+				url, method, body, params := batchEntry(vm, entry)
+				requestBody, headers := encodeRequestBody(vm, body)
+				headers = requestHeaders(vm, headers, params)
+				url, requestBody, headers = hooks.beforeRequest(vm, url, method, requestBody, headers)
+				requests[i] = prepare(url, method, requestBody, headers, params)
+			}
+
+			var wg sync.WaitGroup
+			for _, request := range requests {
+				wg.Add(1)
+				go func(request *pendingRequest) {
+					defer wg.Done()
+					perform(request)
+				}(request)
+			}
+			wg.Wait()
+
+			responses := make([]map[string]interface{}, len(requests))
+			for i, request := range requests {
+				responses[i] = finish(request)
+			}
+			return responses
+		},
+		"onBeforeRequest": func(fn goja.Callable) { hooks.before = append(hooks.before, fn) },
+		"onAfterResponse": func(fn goja.Callable) { hooks.after = append(hooks.after, fn) },
+		"setBasicAuth":    client.SetBasicAuth,
+		"setDigestAuth":   client.SetDigestAuth,
 	}
 }
 
-func createResponseObject(resp httpclient.HttpResponse, err error, metricsChan chan<- metrics.Metrics) map[string]interface{} {
-	return map[string]interface{}{
-		"response": resp,
-		"error":    err,
-		"assertStatus": func(expectedStatus int) map[string]interface{} {
-			if resp.StatusCode != expectedStatus {
-				// Send metrics for failed assertion
+// pendingRequest is a request of the http module between being read from the
+// VM and being wrapped into a response object.
+type pendingRequest struct {
+	url           string
+	method        string
+	body          io.Reader
+	bodyText      string
+	headers       http.Header
+	params        *goja.Object
+	options       httpclient.RequestOptions
+	recorded      bool
+	traceCallback goja.Callable
 
-				if len(fmt.Sprintf("%s %s", resp.Method, resp.URL)) < 5 {
-					fmt.Printf("blank error")
-				}
+	resp httpclient.HttpResponse
+	err  error
+}
 
-				metricsData := metrics.Metrics{
-					EndpointMetricsMap: map[string]*metrics.EndpointMetrics{
-						fmt.Sprintf("%s %s", resp.Method, resp.URL): {
-							URL:              resp.URL,
-							Method:           resp.Method,
-							StatusCodeCounts: map[int]int{resp.StatusCode: 1},
-							Errors:           1,
-							Type:             metrics.Error,
-						},
-					},
-				}
-				metrics.SendMetrics(metricsData, metricsChan)
+// batchEntry reads a request given to http.batch, throwing a TypeError if it
+// is neither a URL nor an object with one.
+func batchEntry(vm *goja.Runtime, entry goja.Value) (url, method string, body goja.Value, params *goja.Object) {
+	if object, ok := entry.(*goja.Object); ok {
+		if target := object.Get("url"); target != nil && !goja.IsUndefined(target) {
+			method = "GET"
+			if value := object.Get("method"); value != nil && !goja.IsUndefined(value) {
+				method = strings.ToUpper(value.String())
 			}
-			return map[string]interface{}{
-				"response": resp,
-				"error":    err,
+			params, _ = object.Get("params").(*goja.Object)
+			return target.String(), method, object.Get("body"), params
+		}
+	} else if entry != nil && !goja.IsUndefined(entry) && !goja.IsNull(entry) {
+		return entry.String(), "GET", nil, nil
+	}
+	panic(vm.NewTypeError("http.batch expects URLs or { method, url, body, params } objects"))
+}
+
+// replayedRequest reads the request kept under res.request by the http
+// module, throwing a TypeError if the value isn't such a response.
+func replayedRequest(vm *goja.Runtime, response *goja.Object) (url, method string, body io.Reader, headers http.Header) {
+	var request *goja.Object
+	if response != nil {
+		if value := response.Get("request"); value != nil && !goja.IsUndefined(value) && !goja.IsNull(value) {
+			request = value.ToObject(vm)
+		}
+	}
+	if request == nil || request.Get("url") == nil || request.Get("method") == nil {
+		panic(vm.NewTypeError("http.replay expects a response returned by the http module"))
+	}
+
+	headers = http.Header{}
+	if value := request.Get("headers"); value != nil && !goja.IsUndefined(value) && !goja.IsNull(value) {
+		object := value.ToObject(vm)
+		for _, name := range object.Keys() {
+			headers.Set(name, object.Get(name).String())
+		}
+	}
+	if value := request.Get("body"); value != nil && !goja.IsUndefined(value) && value.String() != "" {
+		body = strings.NewReader(value.String())
+	}
+	return request.Get("url").String(), request.Get("method").String(), body, headers
+}
+
+// expectedStatusRanges parses the validated config.ExpectedStatus.
+func expectedStatusRanges(specs []string) []httpclient.StatusRange {
+	ranges := make([]httpclient.StatusRange, 0, len(specs))
+	for _, spec := range specs {
+		if statusRange, err := httpclient.ParseStatusRange(spec); err == nil {
+			ranges = append(ranges, statusRange)
+		}
+	}
+	return ranges
+}
+
+// requestHeaders adds params.headers to the headers of a request. They are
+// applied after the defaults, so e.g. a User-Agent set here wins.
+func requestHeaders(vm *goja.Runtime, headers http.Header, params *goja.Object) http.Header {
+	if params == nil {
+		return headers
+	}
+	value := params.Get("headers")
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return headers
+	}
+
+	if headers == nil {
+		headers = http.Header{}
+	}
+	object := value.ToObject(vm)
+	for _, name := range object.Keys() {
+		headers.Set(name, object.Get(name).String())
+	}
+	return headers
+}
+
+// requestTrace reports whether params.trace asks for the request's trace
+// events, and returns the callback to pass them to when it is a function.
+func requestTrace(params *goja.Object) (bool, goja.Callable) {
+	if params == nil {
+		return false, nil
+	}
+	trace := params.Get("trace")
+	if trace == nil {
+		return false, nil
+	}
+	if callback, ok := goja.AssertFunction(trace); ok {
+		return true, callback
+	}
+	return trace.ToBoolean(), nil
+}
+
+// recordsMetrics reports whether a request's metrics are recorded, which is
+// the case unless params.recordMetrics is false.
+func recordsMetrics(params *goja.Object) bool {
+	if params == nil {
+		return true
+	}
+	recordMetrics := params.Get("recordMetrics")
+	return recordMetrics == nil || goja.IsUndefined(recordMetrics) || recordMetrics.ToBoolean()
+}
+
+// requestCompression returns the encoding params.compress asks to compress
+// the request body with, throwing for anything but "gzip".
+func requestCompression(vm *goja.Runtime, params *goja.Object) string {
+	if params == nil {
+		return ""
+	}
+	compress := params.Get("compress")
+	if compress == nil || goja.IsUndefined(compress) || goja.IsNull(compress) {
+		return ""
+	}
+	if compress.String() != "gzip" {
+		panic(vm.NewTypeError("unsupported compression %q, only gzip is supported", compress.String()))
+	}
+	return "gzip"
+}
+
+// requestTags returns params.tags as strings, or nil when there are none.
+func requestTags(params *goja.Object) map[string]string {
+	if params == nil {
+		return nil
+	}
+	tags, ok := params.Get("tags").(*goja.Object)
+	if !ok {
+		return nil
+	}
+	requestTags := make(map[string]string)
+	for _, key := range tags.Keys() {
+		requestTags[key] = tags.Get(key).String()
+	}
+	return requestTags
+}
+
+// traceEventsObject converts trace events for JS. time is the absolute time in
+// milliseconds since the Unix epoch, elapsed the time since the first event.
+func traceEventsObject(events []httpclient.TraceEvent) []map[string]interface{} {
+	traceEvents := make([]map[string]interface{}, len(events))
+	for i, event := range events {
+		traceEvents[i] = map[string]interface{}{
+			"event":   event.Event,
+			"time":    float64(event.Time.UnixNano()) / float64(time.Millisecond),
+			"elapsed": durationToMilliseconds(event.Time.Sub(events[0].Time)),
+			"detail":  event.Detail,
+		}
+	}
+	return traceEvents
+}
+
+// requestHooks holds the functions a script registered to run around every
+// request made on its VM, in registration order.
+type requestHooks struct {
+	before []goja.Callable
+	after  []goja.Callable
+}
+
+// beforeRequest passes {method, url, headers, body} to each before hook and
+// returns the URL and headers as the hooks left them. The body is read into a
+// string for the hooks, so that it can be signed.
+func (h *requestHooks) beforeRequest(vm *goja.Runtime, url, method string, body io.Reader, headers http.Header) (string, io.Reader, http.Header) {
+	if len(h.before) == 0 {
+		return url, body, headers
+	}
+
+	var bodyText string
+	if body != nil {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			panic(vm.NewGoError(err))
+		}
+		bodyText = string(data)
+		body = strings.NewReader(bodyText)
+	}
+
+	headersValue := vm.NewObject()
+	for name, values := range headers {
+		headersValue.Set(name, strings.Join(values, ", "))
+	}
+	request := vm.NewObject()
+	request.Set("method", method)
+	request.Set("url", url)
+	request.Set("headers", headersValue)
+	request.Set("body", bodyText)
+
+	for _, fn := range h.before {
+		if _, err := fn(goja.Undefined(), request); err != nil {
+			panic(err)
+		}
+	}
+
+	headers = http.Header{}
+	hookedHeaders := request.Get("headers").ToObject(vm)
+	for _, name := range hookedHeaders.Keys() {
+		headers.Set(name, hookedHeaders.Get(name).String())
+	}
+	return request.Get("url").String(), body, headers
+}
+
+// afterResponse passes the response object, including its timings, to each
+// after hook.
+func (h *requestHooks) afterResponse(vm *goja.Runtime, responseObject map[string]interface{}) {
+	for _, fn := range h.after {
+		if _, err := fn(goja.Undefined(), vm.ToValue(responseObject)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// encodeRequestBody converts a JS request body into a reader. Strings are sent
+// as is; {form: {...}} is URL-encoded and {json: ...} is serialized as JSON,
+// both with the matching Content-Type header.
+func encodeRequestBody(vm *goja.Runtime, body goja.Value) (io.Reader, http.Header) {
+	if body == nil || goja.IsUndefined(body) || goja.IsNull(body) {
+		return nil, nil
+	}
+
+	if object, ok := body.(*goja.Object); ok {
+		if value := object.Get("json"); value != nil && !goja.IsUndefined(value) {
+			encoded, err := json.Marshal(value.Export())
+			if err != nil {
+				panic(vm.NewTypeError("cannot serialize JSON body: %v", err))
+			}
+			headers := http.Header{}
+			headers.Set("Content-Type", "application/json")
+			return bytes.NewReader(encoded), headers
+		}
+		if form := object.Get("form"); form != nil && !goja.IsUndefined(form) && !goja.IsNull(form) {
+			values := url.Values{}
+			formObject := form.ToObject(vm)
+			for _, name := range formObject.Keys() {
+				field := formObject.Get(name)
+				if items, ok := field.Export().([]interface{}); ok {
+					for _, item := range items {
+						values.Add(name, fmt.Sprint(item))
+					}
+					continue
+				}
+				values.Add(name, field.String())
 			}
+			headers := http.Header{}
+			headers.Set("Content-Type", "application/x-www-form-urlencoded")
+			return strings.NewReader(values.Encode()), headers
+		}
+	}
+
+	return strings.NewReader(body.String()), nil
+}
+
+// runRequestChecks runs the functions in params.checks against the response
+// and records each result as a check named by its key.
+func runRequestChecks(vm *goja.Runtime, responseObject map[string]interface{}, params *goja.Object, metricsChan chan<- metrics.Metrics) {
+	if params == nil {
+		return
+	}
+	checksValue := params.Get("checks")
+	if checksValue == nil || goja.IsUndefined(checksValue) || goja.IsNull(checksValue) {
+		return
+	}
+
+	checks := checksValue.ToObject(vm)
+	responseValue := checkSubject(vm, responseObject)
+	for _, name := range checks.Keys() {
+		fn, ok := goja.AssertFunction(checks.Get(name))
+		if !ok {
+			panic(vm.NewTypeError("check '%s' is not a function", name))
+		}
+
+		// A check that throws counts as a failure; it isn't printed, as this
+		// runs for every response and the failure is already recorded.
+		passed := false
+		if result, err := fn(goja.Undefined(), responseValue); err == nil {
+			passed = result.ToBoolean()
+		}
+		recordAssertion(name, passed, metricsChan)
+	}
+}
+
+// createResponseObject wraps an HTTP response for JS. Every assert* method
+// records its pass/fail result through the metrics pipeline and returns the
+// same object, so assertions can be chained.
+func createResponseObject(vm *goja.Runtime, resp httpclient.HttpResponse, err error, metricsChan chan<- metrics.Metrics) map[string]interface{} {
+	responseObject := map[string]interface{}{
+		"status":     resp.StatusCode,
+		"body":       resp.Body,
+		"headers":    headersObject(resp.Headers),
+		"url":        resp.URL,
+		"method":     resp.Method,
+		"remoteIP":   resp.RemoteIP,
+		"connReused": resp.ConnReused,
+		"requestId":  resp.RequestID,
+		"tls": map[string]interface{}{
+			"version":     resp.TLSVersion,
+			"cipherSuite": resp.TLSCipherSuite,
+		},
+		"error": err,
+		// Deprecated: the raw Go response with Go field names, kept for
+		// scripts written against the old shape. Use the fields above.
+		"response": resp,
+		"timings": map[string]interface{}{
+			"duration": durationToMilliseconds(resp.Duration),
+			"dns":      durationToMilliseconds(resp.DNSLookupLatency),
+			"tcp":      durationToMilliseconds(resp.TCPHandshakeLatency),
+			"tls":      durationToMilliseconds(resp.TLSHandshakeLatency),
+			"ttfb":     durationToMilliseconds(resp.TTFB),
 		},
 	}
+
+	// body is decoded as text for JS; bytes() returns the body exactly as
+	// received, for binary responses.
+	responseObject["bytes"] = func() goja.Value {
+		if resp.BodyBytes == nil {
+			return newUint8Array(vm, []byte(resp.Body))
+		}
+		return newUint8Array(vm, resp.BodyBytes)
+	}
+
+	responseObject["assertStatus"] = func(expectedStatus int) map[string]interface{} {
+		recordAssertion(fmt.Sprintf("status is %d", expectedStatus), resp.StatusCode == expectedStatus, metricsChan)
+		return responseObject
+	}
+	responseObject["assertBodyContains"] = func(substr string) map[string]interface{} {
+		recordAssertion(fmt.Sprintf("body contains %q", substr), strings.Contains(resp.Body, substr), metricsChan)
+		return responseObject
+	}
+	responseObject["assertHeader"] = func(name string, value string) map[string]interface{} {
+		recordAssertion(fmt.Sprintf("header %s is %q", name, value), resp.Headers.Get(name) == value, metricsChan)
+		return responseObject
+	}
+	responseObject["assertJSON"] = func(path string, expected interface{}) map[string]interface{} {
+		recordAssertion(fmt.Sprintf("json %s is %v", path, expected), jsonPathEquals(resp.Body, path, expected), metricsChan)
+		return responseObject
+	}
+
+	return responseObject
+}
+
+// newUint8Array wraps bytes in a JS Uint8Array.
+func newUint8Array(vm *goja.Runtime, data []byte) goja.Value {
+	array, err := vm.New(vm.Get("Uint8Array"), vm.ToValue(vm.NewArrayBuffer(data)))
+	if err != nil {
+		panic(vm.NewGoError(err))
+	}
+	return array
+}
+
+// valueBytes returns the bytes of a Uint8Array or ArrayBuffer, or of the value
+// as a string otherwise.
+func valueBytes(value goja.Value) []byte {
+	switch data := value.Export().(type) {
+	case []byte:
+		return data
+	case goja.ArrayBuffer:
+		return data.Bytes()
+	}
+	return []byte(value.String())
+}
+
+// headersObject flattens response headers for JS, joining repeated headers
+// with ", ".
+func headersObject(headers http.Header) map[string]string {
+	flattened := make(map[string]string, len(headers))
+	for name, values := range headers {
+		flattened[name] = strings.Join(values, ", ")
+	}
+	return flattened
+}
+
+// checkSubject builds the value check functions receive: the response object,
+// plus the Go-named fields of the raw response (StatusCode, Body, ...) so
+// checks written against the old shape keep working.
+func checkSubject(vm *goja.Runtime, responseObject map[string]interface{}) goja.Value {
+	subject := vm.NewObject()
+	if resp, ok := responseObject["response"]; ok {
+		legacy := vm.ToValue(resp).ToObject(vm)
+		for _, name := range legacy.Keys() {
+			subject.Set(name, legacy.Get(name))
+		}
+	}
+	for name, value := range responseObject {
+		subject.Set(name, value)
+	}
+	return subject
+}
+
+// durationToMilliseconds converts a duration to fractional milliseconds for JS.
+func durationToMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// recordAssertion sends the result of a response assertion as a check metric.
+// The check is keyed by its name alone, so a check on URLs with IDs or query
+// strings is still one check, like those of assert.check.
+func recordAssertion(name string, passed bool, metricsChan chan<- metrics.Metrics) {
+	metrics.SendMetrics(metrics.CollectErrorMetrics(name, passed), metricsChan)
+}
+
+// jsonPathEquals reports whether the value at a dot-separated path in a JSON
+// body (e.g. "data.0.id") equals the expected value.
+func jsonPathEquals(body, path string, expected interface{}) bool {
+	var current interface{}
+	if err := json.Unmarshal([]byte(body), &current); err != nil {
+		return false
+	}
+
+	if path != "" {
+		for _, segment := range strings.Split(path, ".") {
+			switch node := current.(type) {
+			case map[string]interface{}:
+				value, ok := node[segment]
+				if !ok {
+					return false
+				}
+				current = value
+			case []interface{}:
+				index, err := strconv.Atoi(segment)
+				if err != nil || index < 0 || index >= len(node) {
+					return false
+				}
+				current = node[index]
+			default:
+				return false
+			}
+		}
+	}
+
+	// Round-trip the expected value so JS numbers compare equal to JSON numbers.
+	expectedJSON, err := json.Marshal(expected)
+	if err != nil {
+		return false
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(expectedJSON, &normalized); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(current, normalized)
 }
 
 // createGroupModule handles the grouping of operations and sends group metrics.
-func createGroupModule(metricsChan chan<- metrics.Metrics) map[string]interface{} {
+func createGroupModule(metricsChan chan<- metrics.Metrics, groups *groupScope) map[string]interface{} {
 	return map[string]interface{}{
-		"start": func(name string, fn goja.Callable) {
+		// start times the group by the wall clock, so parallel requests made
+		// inside it (http.batch) count once, not as the sum of their
+		// durations. A group that throws is still recorded and the error is
+		// passed on; otherwise start returns what the function returned.
+		"start": func(name string, fn goja.Callable) (goja.Value, error) {
+			stats := groups.push()
 			start := time.Now()
-			fn(nil, nil) // Execute the group function
-			duration := time.Since(start)
-			metricsData := metrics.CollectGroupMetrics(name, duration)
-			if metricsChan != nil {
-				metrics.SendMetrics(metricsData, metricsChan)
-			}
+			defer func() {
+				duration := time.Since(start)
+				groups.pop()
+				metricsData := metrics.CollectGroupMetrics(name, duration, stats.requests, stats.errors, stats.bytesReceived, stats.bytesSent)
+				if metricsChan != nil {
+					metrics.SendMetrics(metricsData, metricsChan)
+				}
+			}()
+			return fn(nil, nil) // Execute the group function
 		},
 	}
 }
 
-// createAssertModule provides basic assertion functionalities.
-func createAssertModule(metricsChan chan<- metrics.Metrics, vm *goja.Runtime) map[string]interface{} {
-	return map[string]interface{}{
-		"check": func(response map[string]interface{}, assertions map[string]interface{}) {
-			for name, assertFunc := range assertions {
-				// Check if the assertFunc is callable (goja.Callable)
-				if fn, ok := assertFunc.(func(goja.FunctionCall) goja.Value); ok {
-					responseValue := vm.ToValue(response["response"])
-
-					funcCall := goja.FunctionCall{
-						This:      goja.Undefined(),
-						Arguments: []goja.Value{responseValue},
-					}
-					result := fn(funcCall)
-					// if !result.ToBoolean() {
+// groupStats accumulates the requests made while a group runs.
+type groupStats struct {
+	requests      int
+	errors        int
+	bytesReceived int
+	bytesSent     int
+}
 
-					metricsData := metrics.CollectErrorMetrics(name, result.ToBoolean())
-					// if metricsChan != nil {
-					metrics.SendMetrics(metricsData, metricsChan)
-					// }
-					// }
-				} else {
-					panic(fmt.Sprintf("Invalid assertion function for '%s'", name))
-				}
+// groupScope tracks the groups running on a VM, innermost last, so each
+// request counts towards every group that encloses it.
+type groupScope struct {
+	active []*groupStats
+}
+
+func (s *groupScope) push() *groupStats {
+	stats := &groupStats{}
+	s.active = append(s.active, stats)
+	return stats
+}
+
+func (s *groupScope) pop() {
+	s.active = s.active[:len(s.active)-1]
+}
+
+// record adds a response to all running groups. Transport errors and 4xx/5xx
+// responses count as errors of the flow.
+func (s *groupScope) record(resp httpclient.HttpResponse) {
+	for _, stats := range s.active {
+		stats.requests++
+		if resp.StatusCode == 0 || resp.StatusCode >= 400 {
+			stats.errors++
+		}
+		stats.bytesReceived += resp.BytesReceived
+		stats.bytesSent += resp.BytesSent
+	}
+}
+
+// createAssertModule provides basic assertion functionalities. Each named check
+// is sent under its own name, so repeated runs of the same check aggregate into
+// a single pass/fail line in the report.
+func createAssertModule(config *Config, metricsChan chan<- metrics.Metrics, vm *goja.Runtime) map[string]interface{} {
+	// check returns whether every assertion passed, so scripts can guard
+	// later steps on it; with options.results it returns that as passed
+	// along with each assertion's result by name.
+	check := vm.ToValue(func(response map[string]interface{}, assertions *goja.Object, options *goja.Object) interface{} {
+		responseValue := checkSubject(vm, response)
+		var failed []string
+		results := make(map[string]interface{})
+
+		for _, name := range assertions.Keys() {
+			fn, ok := goja.AssertFunction(assertions.Get(name))
+			if !ok {
+				panic(vm.NewTypeError("assertion '%s' is not a function", name))
 			}
-		},
+
+			// An assertion that throws counts as a failure rather than
+			// aborting the iteration. Nothing is printed: this runs for every
+			// response, and the failure is already recorded.
+			passed := false
+			if result, err := fn(goja.Undefined(), responseValue); err == nil {
+				passed = result.ToBoolean()
+			}
+
+			metricsData := metrics.CollectErrorMetrics(name, passed)
+			metrics.SendMetrics(metricsData, metricsChan)
+			results[name] = passed
+			if !passed {
+				failed = append(failed, name)
+			}
+		}
+
+		// In strict mode a failure aborts the iteration, so later steps
+		// don't run against a bad state.
+		if len(failed) > 0 && options != nil {
+			if abortOnFail := options.Get("abortOnFail"); abortOnFail != nil && abortOnFail.ToBoolean() {
+				panic(vm.NewGoError(fmt.Errorf("check failed: %s", strings.Join(failed, ", "))))
+			}
+		}
+
+		passed := len(failed) == 0
+		if options != nil {
+			if withResults := options.Get("results"); withResults != nil && withResults.ToBoolean() {
+				return map[string]interface{}{"passed": passed, "results": results}
+			}
+		}
+		return passed
+	}).ToObject(vm)
+
+	// check.jsonSchema validates the response body against a JSON Schema
+	// file, recorded as the check "JSON schema <path>". Relative paths are
+	// resolved against the script's directory.
+	check.Set("jsonSchema", func(response map[string]interface{}, schemaPath string) (bool, error) {
+		path := schemaPath
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(config.ScriptDir, path)
+		}
+		schema, err := loadSharedSchema(path)
+		if err != nil {
+			return false, err
+		}
+
+		var violations []string
+		var body interface{}
+		if err := json.Unmarshal([]byte(fmt.Sprint(response["body"])), &body); err != nil {
+			violations = []string{fmt.Sprintf("body is not valid JSON: %v", err)}
+		} else {
+			violations = schema.Validate(body)
+		}
+
+		passed := len(violations) == 0
+		metrics.SendMetrics(metrics.CollectErrorMetrics("JSON schema "+schemaPath, passed), metricsChan)
+		return passed, nil
+	})
+
+	return map[string]interface{}{
+		"check": check,
 	}
 }
 
@@ -186,31 +1262,189 @@ func createCryptoModule() map[string]interface{} {
 			}
 			return bytes
 		},
-		"createHash": func(algorithm string) map[string]interface{} {
-			hash := sha256.New()
+		"aesEncrypt": func(key goja.Value, plaintext goja.Value, encoding string) (string, error) {
+			gcm, err := newAESGCM(valueBytes(key))
+			if err != nil {
+				return "", err
+			}
+			nonce := make([]byte, gcm.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				return "", err
+			}
+			// The nonce is prepended so aesDecrypt can recover it.
+			return encodeBytes(gcm.Seal(nonce, nonce, valueBytes(plaintext), nil), encoding)
+		},
+		"aesDecrypt": func(key goja.Value, ciphertext string, encoding string) (string, error) {
+			gcm, err := newAESGCM(valueBytes(key))
+			if err != nil {
+				return "", err
+			}
+			data, err := decodeBytes(ciphertext, encoding)
+			if err != nil {
+				return "", err
+			}
+			if len(data) < gcm.NonceSize() {
+				return "", fmt.Errorf("ciphertext is too short")
+			}
+			plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+			if err != nil {
+				return "", fmt.Errorf("error decrypting: %w", err)
+			}
+			return string(plaintext), nil
+		},
+		"generateKeyPair": generateKeyPair,
+		// timingSafeEqual compares two digests or signatures in constant time.
+		"timingSafeEqual": func(a goja.Value, b goja.Value) bool {
+			return hmac.Equal(valueBytes(a), valueBytes(b))
+		},
+		"createHash": func(algorithm string) (map[string]interface{}, error) {
+			newHash, err := hashAlgorithm(algorithm)
+			if err != nil {
+				return nil, err
+			}
+			hash := newHash()
 			return map[string]interface{}{
-				"update": func(data string) {
-					hash.Write([]byte(data))
+				"update": func(data goja.Value) {
+					hash.Write(valueBytes(data))
 				},
-				"digest": func(encoding string) string {
-					return util.Base64Encode(hash.Sum(nil))
+				"digest": func(encoding string) (string, error) {
+					return encodeBytes(hash.Sum(nil), encoding)
 				},
+			}, nil
+		},
+		// hashFile streams a file through the hash, so large files are never
+		// held in memory.
+		"hashFile": func(algorithm string, path string, encoding string) (string, error) {
+			newHash, err := hashAlgorithm(algorithm)
+			if err != nil {
+				return "", err
 			}
+			file, err := os.Open(path)
+			if err != nil {
+				return "", err
+			}
+			defer file.Close()
+			hash := newHash()
+			if _, err := io.Copy(hash, file); err != nil {
+				return "", err
+			}
+			return encodeBytes(hash.Sum(nil), encoding)
 		},
-		"createHmac": func(algorithm string, key string) map[string]interface{} {
-			h := hmac.New(sha256.New, []byte(key))
+		"createHmac": func(algorithm string, key string) (map[string]interface{}, error) {
+			newHash, err := hashAlgorithm(algorithm)
+			if err != nil {
+				return nil, err
+			}
+			h := hmac.New(newHash, []byte(key))
 			return map[string]interface{}{
-				"update": func(data string) {
-					h.Write([]byte(data))
+				"update": func(data goja.Value) {
+					h.Write(valueBytes(data))
 				},
-				"digest": func(encoding string) string {
-					return util.Base64Encode(h.Sum(nil))
+				"digest": func(encoding string) (string, error) {
+					return encodeBytes(h.Sum(nil), encoding)
 				},
-			}
+			}, nil
 		},
 	}
 }
 
+// hashAlgorithms are the hash functions of the crypto module by their Node.js
+// names.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// hashAlgorithm returns the hash function of an algorithm name, ignoring case.
+func hashAlgorithm(algorithm string) (func() hash.Hash, error) {
+	newHash, ok := hashAlgorithms[strings.ToLower(algorithm)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %q, expected md5, sha1, sha256, sha384 or sha512", algorithm)
+	}
+	return newHash, nil
+}
+
+// generateKeyPair creates an RSA key pair of the given size in bits (2048 by
+// default) or an EC key pair on the given curve ("P-256" by default), returned
+// as PKCS#8 and PKIX PEM blocks.
+func generateKeyPair(keyType string, param goja.Value) (map[string]interface{}, error) {
+	var privateKey crypto.Signer
+	var err error
+
+	switch keyType {
+	case "rsa":
+		bits := 2048
+		if param != nil && !goja.IsUndefined(param) {
+			bits = int(param.ToInteger())
+		}
+		privateKey, err = rsa.GenerateKey(rand.Reader, bits)
+	case "ec":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curveName := "P-256"
+		if param != nil && !goja.IsUndefined(param) {
+			curveName = param.String()
+		}
+		curve, ok := curves[curveName]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", curveName)
+		}
+		privateKey, err = ecdsa.GenerateKey(curve, rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q, expected rsa or ec", keyType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error generating key: %w", err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding private key: %w", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, fmt.Errorf("error encoding public key: %w", err)
+	}
+
+	return map[string]interface{}{
+		"privateKeyPem": string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})),
+		"publicKeyPem":  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+	}, nil
+}
+
+// newAESGCM returns an AES-GCM cipher for a 16, 24 or 32 byte key.
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AES key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encodeBytes encodes binary data as "base64" (the default) or "hex".
+func encodeBytes(data []byte, encoding string) (string, error) {
+	switch encoding {
+	case "", "base64":
+		return util.Base64Encode(data), nil
+	case "hex":
+		return hex.EncodeToString(data), nil
+	}
+	return "", fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// decodeBytes decodes data encoded by encodeBytes.
+func decodeBytes(data string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "base64":
+		return base64.StdEncoding.DecodeString(data)
+	case "hex":
+		return hex.DecodeString(data)
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
 func createJsonWebTokenModule() map[string]interface{} {
 	return map[string]interface{}{
 		"sign": func(payload map[string]interface{}, privateKey string, options map[string]interface{}) (string, error) {
@@ -219,14 +1453,29 @@ func createJsonWebTokenModule() map[string]interface{} {
 				return "", fmt.Errorf("private key is empty")
 			}
 
-			// Parse the private key
+			// Parse the private key: RSA keys sign with RS256, EC keys with
+			// the ES algorithm matching their curve.
+			var parsedKey interface{}
+			var method jwt.SigningMethod = jwt.SigningMethodRS256
 			parsedKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKey))
 			if err != nil {
-				return "", fmt.Errorf("error parsing private key: %v", err)
+				ecKey, ecErr := jwt.ParseECPrivateKeyFromPEM([]byte(privateKey))
+				if ecErr != nil {
+					return "", fmt.Errorf("error parsing private key: %v", err)
+				}
+				parsedKey = ecKey
+				switch ecKey.Curve.Params().BitSize {
+				case 384:
+					method = jwt.SigningMethodES384
+				case 521:
+					method = jwt.SigningMethodES512
+				default:
+					method = jwt.SigningMethodES256
+				}
 			}
 
 			// Create the token
-			token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims(payload))
+			token := jwt.NewWithClaims(method, jwt.MapClaims(payload))
 			tokenString, err := token.SignedString(parsedKey)
 			if err != nil {
 				return "", fmt.Errorf("error signing token: %v", err)
@@ -241,26 +1490,102 @@ func SetupConsoleModule(vm *goja.Runtime) {
 	console := vm.NewObject()
 
 	console.Set("log", func(call goja.FunctionCall) goja.Value {
-		args := make([]interface{}, len(call.Arguments))
-		for i, arg := range call.Arguments {
-			args[i] = arg.Export()
-		}
-		fmt.Println(args...)
+		fmt.Println(consoleArgs(vm, call.Arguments)...)
 		return nil
 	})
 
 	console.Set("error", func(call goja.FunctionCall) goja.Value {
-		args := make([]interface{}, len(call.Arguments))
-		for i, arg := range call.Arguments {
-			args[i] = arg.Export()
-		}
-		fmt.Fprintln(os.Stderr, args...)
+		fmt.Fprintln(os.Stderr, consoleArgs(vm, call.Arguments)...)
 		return nil
 	})
 
 	vm.Set("console", console)
 }
 
+// consoleArgs formats console arguments for printing. Objects and arrays are
+// printed as indented JSON, colorized when the output is a terminal; other
+// values as Go formats them.
+func consoleArgs(vm *goja.Runtime, arguments []goja.Value) []interface{} {
+	args := make([]interface{}, len(arguments))
+	for i, arg := range arguments {
+		object, isObject := arg.(*goja.Object)
+		if _, isFunction := goja.AssertFunction(arg); !isObject || isFunction {
+			args[i] = arg.Export()
+			continue
+		}
+		if formatted, err := prettyJSON(vm, object); err == nil {
+			args[i] = formatted
+		} else {
+			// e.g. circular objects
+			args[i] = arg.String()
+		}
+	}
+	return args
+}
+
+// prettyJSON returns an object as indented JSON, like
+// JSON.stringify(value, null, 2).
+func prettyJSON(vm *goja.Runtime, object *goja.Object) (string, error) {
+	stringify, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("stringify"))
+	result, err := stringify(goja.Undefined(), object, goja.Null(), vm.ToValue(2))
+	if err != nil {
+		return "", err
+	}
+	return colorizeJSON(result.String()), nil
+}
+
+// colorizeJSON highlights keys, strings, numbers and literals of formatted
+// JSON. It returns the JSON unchanged when color output is disabled.
+func colorizeJSON(formatted string) string {
+	if color.NoColor {
+		return formatted
+	}
+	keyColor := color.New(color.FgCyan).SprintFunc()
+	stringColor := color.New(color.FgGreen).SprintFunc()
+	numberColor := color.New(color.FgYellow).SprintFunc()
+	literalColor := color.New(color.FgMagenta).SprintFunc()
+
+	var out strings.Builder
+	for i := 0; i < len(formatted); {
+		c := formatted[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for end < len(formatted) && formatted[end] != '"' {
+				if formatted[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(formatted))
+			token := formatted[i:end]
+			if strings.HasPrefix(strings.TrimLeft(formatted[end:], " "), ":") {
+				out.WriteString(keyColor(token))
+			} else {
+				out.WriteString(stringColor(token))
+			}
+			i = end
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(formatted) && strings.IndexByte("0123456789.eE+-", formatted[end]) >= 0 {
+				end++
+			}
+			out.WriteString(numberColor(formatted[i:end]))
+			i = end
+		case strings.HasPrefix(formatted[i:], "true"), strings.HasPrefix(formatted[i:], "null"):
+			out.WriteString(literalColor(formatted[i : i+4]))
+			i += 4
+		case strings.HasPrefix(formatted[i:], "false"):
+			out.WriteString(literalColor(formatted[i : i+5]))
+			i += 5
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String()
+}
+
 func InitializeModuleExport(vm *goja.Runtime) *goja.Object {
 	module := vm.NewObject()
 	exports := vm.NewObject()
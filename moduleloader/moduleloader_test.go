@@ -0,0 +1,115 @@
+package moduleloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/accelira/accelira/metrics"
+	"github.com/dop251/goja"
+)
+
+// A group around parallel requests takes as long as the slowest of them, not
+// the sum of their durations
+func TestGroupTimesParallelRequestsByWallClock(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	metricsChan := make(chan metrics.Metrics, 10)
+	vm := goja.New()
+	vm.Set("require", SetupRequire(vm, &Config{}, metricsChan))
+	vm.Set("url", server.URL)
+
+	result, err := vm.RunString(`
+		const http = require("Accelira/http");
+		const group = require("Accelira/group");
+		group.start("parallel", () => http.batch([url, url, { method: "POST", url: url, body: "x" }]).length);
+	`)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if result.ToInteger() != 3 {
+		t.Fatalf("expected the group to return 3 responses, got %v", result)
+	}
+	close(metricsChan)
+
+	var group *metrics.EndpointMetrics
+	requests := 0
+	for m := range metricsChan {
+		for _, epMetrics := range m.EndpointMetricsMap {
+			switch epMetrics.Type {
+			case metrics.Group:
+				group = epMetrics
+			case metrics.HTTPRequest:
+				requests++
+			}
+		}
+	}
+
+	if requests != 3 {
+		t.Fatalf("expected 3 request metrics, got %d", requests)
+	}
+	if group == nil {
+		t.Fatal("expected a group metric")
+	}
+	if group.ChildRequests != 3 {
+		t.Fatalf("expected the group to count 3 requests, got %d", group.ChildRequests)
+	}
+	if group.ResponseTime < delay || group.ResponseTime >= 2*delay {
+		t.Fatalf("expected the group to take about %v, got %v", delay, group.ResponseTime)
+	}
+}
+
+// A bad value in a --config file is returned as an error naming the option,
+// rather than crashing the process
+func TestApplyConfigValuesReportsInvalidValues(t *testing.T) {
+	config := &Config{}
+	err := ApplyConfigValues(config, map[string]interface{}{"maxConcurrentPolicy": "queue"})
+	if err == nil {
+		t.Fatal("expected an error for an invalid max concurrent policy")
+	}
+	if !strings.HasPrefix(err.Error(), `invalid value for "maxConcurrentPolicy": invalid max concurrent policy "queue"`) {
+		t.Fatalf("expected the setter's error, got %v", err)
+	}
+	if config.MaxConcurrentPolicy != "" {
+		t.Fatalf("expected the policy to stay unset, got %q", config.MaxConcurrentPolicy)
+	}
+
+	err = ApplyConfigValues(config, map[string]interface{}{
+		"rateStages": []interface{}{map[string]interface{}{"duration": "1m", "target": "fast"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "rate stage 0 has an invalid target fast") {
+		t.Fatalf("expected an invalid rate stage error, got %v", err)
+	}
+}
+
+// A mistyped duration is reported instead of silently becoming 0
+func TestDurationSettersRejectInvalidValues(t *testing.T) {
+	for _, tc := range []struct {
+		name, value string
+	}{
+		{"gracefulStop", "5"},
+		{"gracefulStop", "-1s"},
+		{"iterationTimeout", "10"},
+		{"iterationTimeout", "-5s"},
+		{"dnsCacheTTL", "30 seconds"},
+		{"dnsCacheTTL", "-1m"},
+	} {
+		config := &Config{}
+		err := ApplyConfigValues(config, map[string]interface{}{tc.name: tc.value})
+		if err == nil || !strings.Contains(err.Error(), tc.value) {
+			t.Errorf("expected an error for %s %q, got %v", tc.name, tc.value, err)
+		}
+	}
+
+	config := &Config{}
+	if err := ApplyConfigValues(config, map[string]interface{}{"gracefulStop": "0s"}); err != nil {
+		t.Fatalf("expected 0s to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package moduleloader
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/accelira/accelira/httpclient"
+	"github.com/dop251/goja"
+)
+
+// SetupSleep adds the sleep(seconds) global, which pauses the VU, and
+// sleep.jitter(min, max), which pauses it for a random time in the range so
+// VUs don't send their requests in synchronized waves. The jitter is drawn
+// from random, so a seeded source makes it reproducible.
+func SetupSleep(vm *goja.Runtime, random *rand.Rand) {
+	sleep := vm.ToValue(func(seconds float64) {
+		sleepFor(seconds)
+	}).ToObject(vm)
+
+	sleep.Set("jitter", func(min, max float64) float64 {
+		if min < 0 || max < min {
+			panic(vm.NewTypeError("invalid jitter range %v to %v, expected 0 <= min <= max", min, max))
+		}
+		seconds := min + random.Float64()*(max-min)
+		sleepFor(seconds)
+		return seconds
+	})
+
+	vm.Set("sleep", sleep)
+}
+
+// sleepFor pauses for the given seconds, returning early if the run is
+// stopped so a sleeping VU doesn't hold up the end of the test.
+func sleepFor(seconds float64) {
+	if seconds <= 0 {
+		return
+	}
+	timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-httpclient.RunContext().Done():
+	}
+}
@@ -0,0 +1,146 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/accelira/accelira/metrics"
+	"github.com/fatih/color"
+)
+
+// EndpointComparison is the difference between a baseline and a current run
+// for one endpoint. Latencies are in milliseconds and error rates in percent.
+type EndpointComparison struct {
+	Endpoint          string
+	BaselineP50       float64
+	CurrentP50        float64
+	BaselineP95       float64
+	CurrentP95        float64
+	BaselineErrorRate float64
+	CurrentErrorRate  float64
+	InBaseline        bool
+	InCurrent         bool
+	Regressed         bool
+}
+
+// P95Change returns the relative change of p95 latency in percent.
+func (c EndpointComparison) P95Change() float64 {
+	return percentChange(c.BaselineP95, c.CurrentP95)
+}
+
+// ErrorRateChange returns the change of the error rate in percentage points.
+func (c EndpointComparison) ErrorRateChange() float64 {
+	return c.CurrentErrorRate - c.BaselineErrorRate
+}
+
+// Compare compares the endpoints of the current run against a baseline. An
+// endpoint regresses when its p95 latency grew by more than p95Threshold
+// percent, when its error rate grew by more than errorThreshold percentage
+// points, or when it is in the baseline but missing from the current run.
+func Compare(baseline, current map[string]*metrics.EndpointMetricsAggregated, p95Threshold, errorThreshold float64) []EndpointComparison {
+	endpoints := comparedEndpoints(current)
+	for _, endpoint := range comparedEndpoints(baseline) {
+		if !isComparable(current[endpoint]) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	sort.Strings(endpoints)
+
+	comparisons := make([]EndpointComparison, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		comparison := EndpointComparison{Endpoint: endpoint}
+
+		if cur := current[endpoint]; isComparable(cur) {
+			comparison.InCurrent = true
+			comparison.CurrentP50 = cur.ResponseTimesTDigest.Quantile(0.5)
+			comparison.CurrentP95 = cur.ResponseTimesTDigest.Quantile(0.95)
+			comparison.CurrentErrorRate = errorRate(cur)
+		}
+
+		if base := baseline[endpoint]; isComparable(base) {
+			comparison.InBaseline = true
+			comparison.BaselineP50 = base.ResponseTimesTDigest.Quantile(0.5)
+			comparison.BaselineP95 = base.ResponseTimesTDigest.Quantile(0.95)
+			comparison.BaselineErrorRate = errorRate(base)
+			comparison.Regressed = !comparison.InCurrent ||
+				comparison.P95Change() > p95Threshold ||
+				comparison.ErrorRateChange() > errorThreshold
+		}
+
+		comparisons = append(comparisons, comparison)
+	}
+	return comparisons
+}
+
+// comparedEndpoints returns the endpoints and groups of a run that made
+// requests.
+func comparedEndpoints(metricsMap map[string]*metrics.EndpointMetricsAggregated) []string {
+	endpoints := make([]string, 0, len(metricsMap))
+	for endpoint, epMetrics := range metricsMap {
+		if isComparable(epMetrics) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+func isComparable(epMetrics *metrics.EndpointMetricsAggregated) bool {
+	return epMetrics != nil && (epMetrics.Type == metrics.HTTPRequest || epMetrics.Type == metrics.Group) && epMetrics.TotalRequests > 0
+}
+
+// PrintComparison prints a per-endpoint diff and reports whether any endpoint regressed.
+func PrintComparison(comparisons []EndpointComparison, p95Threshold, errorThreshold float64) bool {
+	color.New(color.FgCyan, color.Bold).Println("\nBaseline Comparison")
+	fmt.Printf("  Regression threshold: p95 +%.2f%%, errors +%.2f pp\n\n", p95Threshold, errorThreshold)
+
+	regressed := false
+	for _, c := range comparisons {
+		if !c.InBaseline {
+			color.New(color.FgYellow).Printf("  ? %s (not in baseline)\n", c.Endpoint)
+			fmt.Printf("    p50=%.0fms p95=%.0fms errors=%.2f%%\n", c.CurrentP50, c.CurrentP95, c.CurrentErrorRate)
+			continue
+		}
+		if !c.InCurrent {
+			color.New(color.FgRed).Printf("  ✗ %s (missing from current run)\n", c.Endpoint)
+			fmt.Printf("    baseline p50=%.0fms p95=%.0fms errors=%.2f%%\n", c.BaselineP50, c.BaselineP95, c.BaselineErrorRate)
+			regressed = true
+			continue
+		}
+
+		status, statusColor := "✓", color.FgGreen
+		if c.Regressed {
+			status, statusColor = "✗", color.FgRed
+			regressed = true
+		}
+		color.New(statusColor).Printf("  %s %s\n", status, c.Endpoint)
+		fmt.Printf("    p50: %.0fms -> %.0fms (%+.2f%%) | p95: %.0fms -> %.0fms (%+.2f%%) | errors: %.2f%% -> %.2f%% (%+.2f pp)\n",
+			c.BaselineP50, c.CurrentP50, percentChange(c.BaselineP50, c.CurrentP50),
+			c.BaselineP95, c.CurrentP95, c.P95Change(),
+			c.BaselineErrorRate, c.CurrentErrorRate, c.ErrorRateChange())
+	}
+	return regressed
+}
+
+// errorRate returns the percentage of requests to an endpoint, or made inside
+// a group, that failed.
+func errorRate(epMetrics *metrics.EndpointMetricsAggregated) float64 {
+	requests := epMetrics.TotalRequests
+	if epMetrics.Type == metrics.Group {
+		requests = epMetrics.TotalChildRequests
+	}
+	if requests == 0 {
+		return 0
+	}
+	return float64(epMetrics.TotalErrors) / float64(requests) * 100
+}
+
+// percentChange returns the relative change from before to after in percent.
+func percentChange(before, after float64) float64 {
+	if before == 0 {
+		if after == 0 {
+			return 0
+		}
+		return 100
+	}
+	return (after - before) / before * 100
+}
@@ -0,0 +1,92 @@
+package report
+
+import (
+	"testing"
+
+	"github.com/accelira/accelira/metrics"
+	"github.com/influxdata/tdigest"
+)
+
+// endpoint returns an HTTP endpoint with the given latencies in ms and errors.
+func endpoint(errors int, latencies ...float64) *metrics.EndpointMetricsAggregated {
+	digest := tdigest.New()
+	for _, latency := range latencies {
+		digest.Add(latency, 1)
+	}
+	return &metrics.EndpointMetricsAggregated{
+		Type:                 metrics.HTTPRequest,
+		TotalRequests:        len(latencies),
+		TotalErrors:          errors,
+		ResponseTimesTDigest: digest,
+	}
+}
+
+func comparisonOf(t *testing.T, comparisons []EndpointComparison, name string) EndpointComparison {
+	t.Helper()
+	for _, c := range comparisons {
+		if c.Endpoint == name {
+			return c
+		}
+	}
+	t.Fatalf("expected a comparison for %q, got %+v", name, comparisons)
+	return EndpointComparison{}
+}
+
+func TestCompareRegressesOnLatency(t *testing.T) {
+	baseline := map[string]*metrics.EndpointMetricsAggregated{"GET /": endpoint(0, 100, 100, 100, 100)}
+	current := map[string]*metrics.EndpointMetricsAggregated{"GET /": endpoint(0, 120, 120, 120, 120)}
+
+	if c := comparisonOf(t, Compare(baseline, current, 10, 0), "GET /"); !c.Regressed {
+		t.Fatalf("expected a 20%% slower p95 to regress, got %+v", c)
+	}
+	if c := comparisonOf(t, Compare(baseline, current, 25, 0), "GET /"); c.Regressed {
+		t.Fatalf("expected a 20%% slower p95 to pass a 25%% threshold, got %+v", c)
+	}
+}
+
+// Failing fast can lower p95, so the error rate is compared on its own
+func TestCompareRegressesOnErrorRate(t *testing.T) {
+	baseline := map[string]*metrics.EndpointMetricsAggregated{"GET /": endpoint(0, 100, 100, 100, 100)}
+	current := map[string]*metrics.EndpointMetricsAggregated{"GET /": endpoint(4, 5, 5, 5, 5)}
+
+	c := comparisonOf(t, Compare(baseline, current, 10, 0), "GET /")
+	if !c.Regressed {
+		t.Fatalf("expected errors going from 0%% to 100%% to regress, got %+v", c)
+	}
+	if c.ErrorRateChange() != 100 {
+		t.Fatalf("expected an error rate change of 100 pp, got %v", c.ErrorRateChange())
+	}
+
+	current["GET /"] = endpoint(1, 100, 100, 100, 100)
+	if c := comparisonOf(t, Compare(baseline, current, 10, 30), "GET /"); c.Regressed {
+		t.Fatalf("expected 25 pp more errors to pass a 30 pp threshold, got %+v", c)
+	}
+}
+
+func TestCompareReportsMissingAndNewEndpoints(t *testing.T) {
+	baseline := map[string]*metrics.EndpointMetricsAggregated{"GET /old": endpoint(0, 100)}
+	current := map[string]*metrics.EndpointMetricsAggregated{"GET /new": endpoint(0, 100)}
+
+	comparisons := Compare(baseline, current, 10, 0)
+	if missing := comparisonOf(t, comparisons, "GET /old"); missing.InCurrent || !missing.Regressed {
+		t.Fatalf("expected an endpoint missing from the current run to regress, got %+v", missing)
+	}
+	if added := comparisonOf(t, comparisons, "GET /new"); added.InBaseline || added.Regressed {
+		t.Fatalf("expected a new endpoint to be reported without regressing, got %+v", added)
+	}
+}
+
+func TestPercentChange(t *testing.T) {
+	for _, tc := range []struct {
+		before, after, want float64
+	}{
+		{100, 110, 10},
+		{100, 50, -50},
+		{0, 0, 0},
+		{0, 5, 100},
+	} {
+		if got := percentChange(tc.before, tc.after); got != tc.want {
+			t.Errorf("percentChange(%v, %v) = %v, want %v", tc.before, tc.after, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package report
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/accelira/accelira/metrics"
+)
+
+// csvOutput writes one row per endpoint to a CSV file.
+type csvOutput struct {
+	path string
+}
+
+func newCSVOutput(path string) (Output, error) {
+	if path == "" {
+		return nil, fmt.Errorf("csv output requires a file, e.g. csv=results.csv")
+	}
+	return csvOutput{path: path}, nil
+}
+
+func (o csvOutput) HandleSummary(metricsMap *map[string]*metrics.EndpointMetricsAggregated) error {
+	file, err := os.Create(o.path)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", o.path, err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"endpoint", "type", "requests", "errors", "avg_ms", "min_ms", "med_ms", "max_ms", "p90_ms", "p95_ms", "bytes_received", "bytes_sent"})
+
+	endpoints := make([]string, 0, len(*metricsMap))
+	for endpoint := range *metricsMap {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	for _, endpoint := range endpoints {
+		epMetrics := (*metricsMap)[endpoint]
+		// Endpoints whose requests were all aborted have no response times
+		if (epMetrics.Type != metrics.HTTPRequest && epMetrics.Type != metrics.Group) || epMetrics.TotalRequests == 0 {
+			continue
+		}
+
+		avg := 0.0
+		if epMetrics.TotalRequests > 0 {
+			avg = float64(epMetrics.TotalResponseTime.Milliseconds()) / float64(epMetrics.TotalRequests)
+		}
+		digest := epMetrics.ResponseTimesTDigest
+		writer.Write([]string{
+			endpoint,
+			string(epMetrics.Type),
+			strconv.Itoa(epMetrics.TotalRequests),
+			strconv.Itoa(epMetrics.TotalErrors),
+			formatFloat(avg),
+			formatFloat(digest.Quantile(0)),
+			formatFloat(digest.Quantile(0.5)),
+			formatFloat(digest.Quantile(1)),
+			formatFloat(digest.Quantile(0.9)),
+			formatFloat(digest.Quantile(0.95)),
+			strconv.Itoa(epMetrics.TotalBytesReceived),
+			strconv.Itoa(epMetrics.TotalBytesSent),
+		})
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error writing %s: %w", o.path, err)
+	}
+	fmt.Printf("Results written to %s\n", o.path)
+	return nil
+}
+
+// formatFloat formats a number with up to two decimals.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
@@ -0,0 +1,89 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/accelira/accelira/metrics"
+	"github.com/accelira/accelira/metricsprocessor"
+)
+
+// Results is the JSON export of a run. Aggregates include their t-digest
+// centroids, so exported runs can be merged and compared later. Percentiles
+// holds the SummaryPercentiles of each endpoint's response time in
+// milliseconds, for consumers that don't decode t-digests.
+type Results struct {
+	Metrics     map[string]*metrics.EndpointMetricsAggregated
+	Percentiles map[string]map[string]float64 `json:",omitempty"`
+	TimeSeries  []*metrics.TimeBucket         `json:",omitempty"`
+}
+
+// WriteJSON exports the aggregated metrics and the time series of the current
+// run to a JSON file.
+func WriteJSON(path string, metricsMap map[string]*metrics.EndpointMetricsAggregated) error {
+	results := Results{
+		Metrics:     metricsMap,
+		Percentiles: responseTimePercentiles(metricsMap),
+		TimeSeries:  metricsprocessor.TimeSeries,
+	}
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding results: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("error writing results to %s: %w", path, err)
+	}
+	return nil
+}
+
+// responseTimePercentiles returns the SummaryPercentiles of the response time
+// of every request and group, keyed by endpoint and label.
+func responseTimePercentiles(metricsMap map[string]*metrics.EndpointMetricsAggregated) map[string]map[string]float64 {
+	percentiles := make(map[string]map[string]float64)
+	for key, aggregated := range metricsMap {
+		if aggregated.ResponseTimesTDigest == nil || aggregated.TotalRequests == 0 || (aggregated.Type != metrics.HTTPRequest && aggregated.Type != metrics.Group) {
+			continue
+		}
+		values := make(map[string]float64, len(SummaryPercentiles))
+		for _, percentile := range SummaryPercentiles {
+			values[PercentileLabel(percentile)] = aggregated.ResponseTimesTDigest.Quantile(percentile / 100)
+		}
+		percentiles[key] = values
+	}
+	return percentiles
+}
+
+// ReadJSON loads aggregated metrics exported by WriteJSON.
+func ReadJSON(path string) (map[string]*metrics.EndpointMetricsAggregated, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading results from %s: %w", path, err)
+	}
+
+	var results Results
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("error decoding results from %s: %w", path, err)
+	}
+	return results.Metrics, nil
+}
+
+// jsonOutput writes the results to a JSON file.
+type jsonOutput struct {
+	path string
+}
+
+func newJSONOutput(path string) (Output, error) {
+	if path == "" {
+		return nil, fmt.Errorf("json output requires a file, e.g. json=results.json")
+	}
+	return jsonOutput{path: path}, nil
+}
+
+func (o jsonOutput) HandleSummary(metricsMap *map[string]*metrics.EndpointMetricsAggregated) error {
+	if err := WriteJSON(o.path, *metricsMap); err != nil {
+		return err
+	}
+	fmt.Printf("Results written to %s\n", o.path)
+	return nil
+}
@@ -0,0 +1,85 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/accelira/accelira/metrics"
+)
+
+// influxDBOutput writes per-endpoint summaries to an InfluxDB 1.x database
+// using the line protocol, e.g. influxdb=http://localhost:8086/accelira.
+type influxDBOutput struct {
+	writeURL string
+}
+
+func newInfluxDBOutput(arg string) (Output, error) {
+	address, database, ok := cutLast(arg, "/")
+	if !ok || database == "" || !strings.HasPrefix(address, "http") {
+		return nil, fmt.Errorf("influxdb output requires a URL and database, e.g. influxdb=http://localhost:8086/accelira")
+	}
+	return influxDBOutput{writeURL: fmt.Sprintf("%s/write?db=%s&precision=ms", address, database)}, nil
+}
+
+func (o influxDBOutput) HandleSummary(metricsMap *map[string]*metrics.EndpointMetricsAggregated) error {
+	var lines bytes.Buffer
+	timestamp := time.Now().UnixMilli()
+
+	for endpoint, epMetrics := range *metricsMap {
+		// Endpoints whose requests were all aborted have no response times
+		if (epMetrics.Type != metrics.HTTPRequest && epMetrics.Type != metrics.Group) || epMetrics.TotalRequests == 0 {
+			continue
+		}
+		digest := epMetrics.ResponseTimesTDigest
+		fmt.Fprintf(&lines, "accelira_endpoint,endpoint=%s,type=%s%s requests=%di,errors=%di,med=%f,p90=%f,p95=%f,max=%f,bytes_received=%di,bytes_sent=%di %d\n",
+			escapeTag(endpoint), epMetrics.Type, lineTags(epMetrics.Tags),
+			epMetrics.TotalRequests, epMetrics.TotalErrors,
+			digest.Quantile(0.5), digest.Quantile(0.9), digest.Quantile(0.95), digest.Quantile(1),
+			epMetrics.TotalBytesReceived, epMetrics.TotalBytesSent, timestamp)
+	}
+
+	resp, err := http.Post(o.writeURL, "text/plain", &lines)
+	if err != nil {
+		return fmt.Errorf("error writing to InfluxDB: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("error writing to InfluxDB: %s", resp.Status)
+	}
+	return nil
+}
+
+// escapeTag escapes a line protocol tag value.
+func escapeTag(value string) string {
+	return strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ").Replace(value)
+}
+
+// lineTags formats tags as line protocol tags, sorted by name as InfluxDB
+// recommends. Tags named like the endpoint or type tags are left out.
+func lineTags(tags map[string]string) string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		if name != "endpoint" && name != "type" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, ",%s=%s", escapeTag(name), escapeTag(tags[name]))
+	}
+	return b.String()
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
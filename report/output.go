@@ -0,0 +1,80 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/accelira/accelira/metrics"
+)
+
+// Output receives the aggregated results at the end of a run.
+type Output interface {
+	HandleSummary(metricsMap *map[string]*metrics.EndpointMetricsAggregated) error
+}
+
+// StreamingOutput is an Output that also receives every metric as it is
+// collected during the run.
+type StreamingOutput interface {
+	Output
+	HandleMetric(metric metrics.Metrics)
+}
+
+// OutputFactory creates an output from the argument after "=" in --out
+// (e.g. the file name in "json=results.json"), which may be empty.
+type OutputFactory func(arg string) (Output, error)
+
+var (
+	outputFactories      = make(map[string]OutputFactory)
+	outputFactoriesMutex sync.RWMutex
+)
+
+// RegisterOutput makes an output available to --out under the given name.
+func RegisterOutput(name string, factory OutputFactory) {
+	outputFactoriesMutex.Lock()
+	defer outputFactoriesMutex.Unlock()
+	outputFactories[name] = factory
+}
+
+// OutputNames returns the names of all registered outputs.
+func OutputNames() []string {
+	outputFactoriesMutex.RLock()
+	defer outputFactoriesMutex.RUnlock()
+
+	names := make([]string, 0, len(outputFactories))
+	for name := range outputFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewOutput creates an output from a --out value of the form "name" or "name=arg".
+func NewOutput(spec string) (Output, error) {
+	name, arg, _ := strings.Cut(spec, "=")
+
+	outputFactoriesMutex.RLock()
+	factory, ok := outputFactories[name]
+	outputFactoriesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown output %q (available: %s)", name, strings.Join(OutputNames(), ", "))
+	}
+	return factory(arg)
+}
+
+func init() {
+	RegisterOutput("console", func(arg string) (Output, error) { return consoleOutput{}, nil })
+	RegisterOutput("json", newJSONOutput)
+	RegisterOutput("csv", newCSVOutput)
+	RegisterOutput("influxdb", newInfluxDBOutput)
+	RegisterOutput("sqlite", newSQLiteOutput)
+}
+
+// consoleOutput prints the human-readable report.
+type consoleOutput struct{}
+
+func (consoleOutput) HandleSummary(metricsMap *map[string]*metrics.EndpointMetricsAggregated) error {
+	NewReportGenerator(metricsMap).GenerateReport()
+	return nil
+}
@@ -0,0 +1,36 @@
+package report
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SummaryPercentiles are the latency percentiles shown in the report and
+// included in the JSON export.
+var SummaryPercentiles = []float64{90, 95}
+
+// MetricsSampleRate is the fraction of requests whose latencies went into the
+// digests, 0 if all did. The report notes it, as percentiles are then
+// estimated from a sample.
+var MetricsSampleRate float64
+
+// ParsePercentiles parses percentiles given as "p90", "p99.9" or "99".
+func ParsePercentiles(specs []string) ([]float64, error) {
+	percentiles := make([]float64, 0, len(specs))
+	for _, spec := range specs {
+		trimmed := strings.TrimSpace(spec)
+		trimmed = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(trimmed, "p"), "("), ")")
+		percentile, err := strconv.ParseFloat(trimmed, 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("invalid percentile %q, expected e.g. p99 or p99.9", spec)
+		}
+		percentiles = append(percentiles, percentile)
+	}
+	return percentiles, nil
+}
+
+// PercentileLabel formats a percentile as in the report, e.g. "p(99.9)".
+func PercentileLabel(percentile float64) string {
+	return "p(" + strconv.FormatFloat(percentile, 'f', -1, 64) + ")"
+}
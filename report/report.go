@@ -3,10 +3,12 @@ package report
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/accelira/accelira/metrics"
+	"github.com/accelira/accelira/metricsprocessor"
 	"github.com/fatih/color"
 )
 
@@ -15,8 +17,13 @@ type ReportGenerator struct {
 	metricsMap *map[string]*metrics.EndpointMetricsAggregated
 }
 
-// NewReportGenerator creates a new ReportGenerator instance.
+// NewReportGenerator creates a new ReportGenerator instance. With OnlyTags
+// set, the report covers only the entries having those tags.
 func NewReportGenerator(metricsMap *map[string]*metrics.EndpointMetricsAggregated) *ReportGenerator {
+	if len(OnlyTags) > 0 {
+		filtered := filterByTags(*metricsMap, OnlyTags)
+		metricsMap = &filtered
+	}
 	return &ReportGenerator{
 		metricsMap: metricsMap,
 	}
@@ -27,32 +34,66 @@ func (rg *ReportGenerator) GenerateReport() {
 	rg.printSummary()
 	rg.printChecks()
 	rg.printDetailedReport()
+	if ByURL {
+		rg.printURLRollup()
+	}
+	rg.printTimeSeries()
 }
 
 // printSummary prints the summary of the performance test.
 func (rg *ReportGenerator) printSummary() {
 	color.New(color.FgCyan, color.Bold).Println("\nPerformance Test Report")
+	if len(OnlyTags) > 0 {
+		fmt.Printf("  Filtered by tags: %s\n", formatTags(OnlyTags))
+	}
 	color.New(color.FgWhite).Println("\nSummary:")
 
-	totalRequests, totalErrors, totalDuration, totalBytesReceived, totalBytesSent := rg.aggregateMetrics()
+	totalRequests, totalErrors, totalAborted, totalDuration, totalBytesReceived, totalBytesSent := rg.aggregateMetrics()
 
 	fmt.Printf("  Total Requests:   %d\n", totalRequests)
+	if iterations, ok := (*rg.metricsMap)[metrics.IterationsKey]; ok && iterations.TotalRequests > 0 {
+		fmt.Printf("  Iterations:       %d (%.2f requests/iteration)\n",
+			iterations.TotalRequests, float64(totalRequests)/float64(iterations.TotalRequests))
+		fmt.Printf("  Iteration Duration: avg=%v min=%v med=%v max=%v %s\n",
+			rg.roundDurationToTwoDecimals(iterations.TotalResponseTime/time.Duration(iterations.TotalRequests)),
+			rg.quantileDuration(iterations, 0), rg.quantileDuration(iterations, 0.5), rg.quantileDuration(iterations, 1),
+			rg.formatPercentiles(iterations, rg.quantileDuration))
+	}
+	if delays, ok := (*rg.metricsMap)[metrics.SchedulingDelayKey]; ok && delays.TotalRequests > 0 {
+		fmt.Printf("  Scheduling Delay: avg=%v min=%v med=%v max=%v %s\n",
+			rg.roundDurationToTwoDecimals(delays.TotalResponseTime/time.Duration(delays.TotalRequests)),
+			rg.quantileDuration(delays, 0), rg.quantileDuration(delays, 0.5), rg.quantileDuration(delays, 1),
+			rg.formatPercentiles(delays, rg.quantileDuration))
+	}
+	if dropped, ok := (*rg.metricsMap)[metrics.DroppedIterationsKey]; ok && dropped.TotalRequests > 0 {
+		color.New(color.FgYellow).Printf("  Dropped Iterations: %d (concurrency limit reached, load was shed)\n", dropped.TotalRequests)
+	}
 	fmt.Printf("  Total Errors:     %d\n", totalErrors)
+	if totalAborted > 0 {
+		fmt.Printf("  Total Aborted:    %d\n", totalAborted)
+	}
 	fmt.Printf("  Total Duration:   %v\n", totalDuration)
 	fmt.Printf("  Total BytesReceived:   %v\n", totalBytesReceived)
 	fmt.Printf("  Total BytesSent:   %v\n", totalBytesSent)
 
 	rg.printAverageDuration(totalRequests, totalDuration)
+
+	if MetricsSampleRate > 0 && MetricsSampleRate < 1 {
+		color.New(color.FgYellow).Printf("  Metrics Sample Rate: %g%% (percentiles are estimated from sampled requests; counts include all)\n", MetricsSampleRate*100)
+	}
+
+	if dropped := metrics.DroppedMetrics(); dropped > 0 {
+		color.New(color.FgYellow).Printf("  Dropped Metrics:  %d (metrics channel full, consider --metrics-buffer)\n", dropped)
+	}
 }
 
 // printChecks prints the status of various checks.
 func (rg *ReportGenerator) printChecks() {
 	color.New(color.FgMagenta).Println("\nChecks Status:")
 
-	for key, epMetrics := range *rg.metricsMap {
-		if epMetrics.Type == metrics.Error {
-			rg.printCheckStatus(key, epMetrics)
-		}
+	isCheck := func(epMetrics *metrics.EndpointMetricsAggregated) bool { return epMetrics.Type == metrics.Error }
+	for _, key := range sortedKeys(*rg.metricsMap, isCheck) {
+		rg.printCheckStatus(key, (*rg.metricsMap)[key])
 	}
 }
 
@@ -89,12 +130,13 @@ func (rg *ReportGenerator) calculateRate(count, total int) float64 {
 }
 
 // aggregateMetrics aggregates the total requests, errors, and duration from all endpoints.
-func (rg *ReportGenerator) aggregateMetrics() (totalRequests, totalErrors int, totalDuration time.Duration, totalBytesReceived int, totalBytesSent int) {
+func (rg *ReportGenerator) aggregateMetrics() (totalRequests, totalErrors, totalAborted int, totalDuration time.Duration, totalBytesReceived int, totalBytesSent int) {
 
 	for _, epMetrics := range *rg.metricsMap {
 		if epMetrics.Type == metrics.HTTPRequest {
 			totalRequests += epMetrics.TotalRequests
 			totalErrors += epMetrics.TotalErrors
+			totalAborted += epMetrics.TotalAborted
 			totalDuration += epMetrics.TotalResponseTime
 			totalBytesReceived += epMetrics.TotalBytesReceived
 			totalBytesSent += epMetrics.TotalBytesSent
@@ -117,63 +159,167 @@ func (rg *ReportGenerator) printAverageDuration(totalRequests int, totalDuration
 func (rg *ReportGenerator) printDetailedReport() {
 	color.New(color.FgWhite, color.Bold).Println("\nEndpoint Metrics:")
 
-	for endpoint, epMetrics := range *rg.metricsMap {
-		if epMetrics.Type == metrics.HTTPRequest || epMetrics.Type == metrics.Group {
-			rg.printEndpointMetrics(endpoint, epMetrics)
+	isEndpoint := func(epMetrics *metrics.EndpointMetricsAggregated) bool {
+		return epMetrics.Type == metrics.HTTPRequest || epMetrics.Type == metrics.Group
+	}
+	for _, endpoint := range sortedKeys(*rg.metricsMap, isEndpoint) {
+		rg.printEndpointMetrics(endpoint, (*rg.metricsMap)[endpoint])
+	}
+}
+
+// printTimeSeries prints request counts and latencies per time bucket, which
+// shows degradation over the run that the overall aggregates hide.
+func (rg *ReportGenerator) printTimeSeries() {
+	timeSeries := metricsprocessor.TimeSeries
+	if len(timeSeries) < 2 {
+		return
+	}
+
+	color.New(color.FgWhite, color.Bold).Printf("\nTime Series (%v buckets):\n", metricsprocessor.TimeSeriesInterval)
+
+	first := timeSeries[0].Start
+	for _, bucket := range timeSeries {
+		quantile := func(q float64) time.Duration {
+			return time.Duration(bucket.ResponseTimesTDigest.Quantile(q)) * time.Millisecond
 		}
+		fmt.Printf("  +%-8v requests=%d errors=%d med=%v p(95)=%v max=%v\n",
+			bucket.Start.Sub(first), bucket.Requests, bucket.Errors, quantile(0.5), quantile(0.95), quantile(1))
 	}
 }
 
 // printEndpointMetrics prints the metrics for a specific endpoint.
 func (rg *ReportGenerator) printEndpointMetrics(endpoint string, epMetrics *metrics.EndpointMetricsAggregated) {
+	// An endpoint whose requests were all aborted has no response times
+	if epMetrics.TotalRequests == 0 {
+		fmt.Printf("  %s%s aborted=%d\n", endpoint, rg.generateDots(endpoint, 35), epMetrics.TotalAborted)
+		return
+	}
+
 	avg := rg.roundDurationToTwoDecimals(epMetrics.TotalResponseTime / time.Duration(epMetrics.TotalRequests))
 	min := rg.quantileDuration(epMetrics, 0.0)
 	med := rg.quantileDuration(epMetrics, 0.5)
 	max := rg.quantileDuration(epMetrics, 1.0)
-	p90 := rg.quantileDuration(epMetrics, 0.9)
-	p95 := rg.quantileDuration(epMetrics, 0.95)
 
 	// TCP Handshake Latency
 	tcpMin := rg.quantileTCPHandshakeDuration(epMetrics, 0.0)
 	tcpMed := rg.quantileTCPHandshakeDuration(epMetrics, 0.5)
 	tcpMax := rg.quantileTCPHandshakeDuration(epMetrics, 1.0)
-	tcpP90 := rg.quantileTCPHandshakeDuration(epMetrics, 0.9)
-	tcpP95 := rg.quantileTCPHandshakeDuration(epMetrics, 0.95)
 
 	// DNS Lookup Latency
 	dnsMin := rg.quantileDNSLookupDuration(epMetrics, 0.0)
 	dnsMed := rg.quantileDNSLookupDuration(epMetrics, 0.5)
 	dnsMax := rg.quantileDNSLookupDuration(epMetrics, 1.0)
-	dnsP90 := rg.quantileDNSLookupDuration(epMetrics, 0.9)
-	dnsP95 := rg.quantileDNSLookupDuration(epMetrics, 0.95)
 
 	// TLS Handshake Latency
 	tlsMin := rg.quantileTLSHandshakeDuration(epMetrics, 0.0)
 	tlsMed := rg.quantileTLSHandshakeDuration(epMetrics, 0.5)
 	tlsMax := rg.quantileTLSHandshakeDuration(epMetrics, 1.0)
-	tlsP90 := rg.quantileTLSHandshakeDuration(epMetrics, 0.9)
-	tlsP95 := rg.quantileTLSHandshakeDuration(epMetrics, 0.95)
+
+	// Time To First Byte
+	ttfbMin := rg.quantileTTFBDuration(epMetrics, 0.0)
+	ttfbMed := rg.quantileTTFBDuration(epMetrics, 0.5)
+	ttfbMax := rg.quantileTTFBDuration(epMetrics, 1.0)
+
+	// Content Download (first byte to last byte)
+	downloadMin := rg.quantileBodyReceiveDuration(epMetrics, 0.0)
+	downloadMed := rg.quantileBodyReceiveDuration(epMetrics, 0.5)
+	downloadMax := rg.quantileBodyReceiveDuration(epMetrics, 1.0)
 
 	dots := rg.generateDots(endpoint, 35) // Adjust total length as needed
 
-	fmt.Printf("  %s%s avg=%v min=%v med=%v max=%v p(90)=%v p(95)=%v\n",
-		endpoint, dots, avg, min, med, max, p90, p95)
+	fmt.Printf("  %s%s avg=%v min=%v med=%v max=%v %s\n",
+		endpoint, dots, avg, min, med, max, rg.formatPercentiles(epMetrics, rg.quantileDuration))
+
+	mean, stdDev, coefficientOfVariation := epMetrics.ResponseTimeSpread()
+	fmt.Printf("    └── Mean: %v | StdDev: %v | CV: %.2f%%\n",
+		mean.Round(time.Microsecond), stdDev.Round(time.Microsecond), coefficientOfVariation*100)
+
+	if trend := rg.formatTrend(epMetrics); trend != "" {
+		fmt.Printf("    └── Trend: %s\n", trend)
+	}
+
+	if epMetrics.Type == metrics.Group && epMetrics.TotalChildRequests > 0 {
+		fmt.Printf("    └── Requests: %d (%.2f per run) | Errors: %.2f%% (%d) | BytesReceived: %d | BytesSent: %d\n",
+			epMetrics.TotalChildRequests, float64(epMetrics.TotalChildRequests)/float64(epMetrics.TotalRequests),
+			rg.calculateRate(epMetrics.TotalErrors, epMetrics.TotalChildRequests), epMetrics.TotalErrors,
+			epMetrics.TotalBytesReceived, epMetrics.TotalBytesSent)
+	}
 
 	if epMetrics.Type == metrics.HTTPRequest {
+		fmt.Printf("    └── Max Concurrent In-Flight: %d\n", epMetrics.MaxInFlight)
+
+		if epMetrics.TotalNotModified > 0 {
+			fmt.Printf("    └── Cache Hit Rate (304): %.2f%% (%d / %d)\n",
+				rg.calculateRate(epMetrics.TotalNotModified, epMetrics.TotalRequests), epMetrics.TotalNotModified, epMetrics.TotalRequests)
+		}
+
+		if epMetrics.TotalRateLimited > 0 {
+			fmt.Printf("    └── Rate Limited: %.2f%% (%d / %d)\n",
+				rg.calculateRate(epMetrics.TotalRateLimited, epMetrics.TotalRequests), epMetrics.TotalRateLimited, epMetrics.TotalRequests)
+		}
+
+		if epMetrics.TotalClientErrors > 0 || epMetrics.TotalServerErrors > 0 || epMetrics.TotalTransportErrors > 0 {
+			fmt.Printf("    └── Errors by Class: 4xx: %d | 5xx: %d | Transport: %d\n",
+				epMetrics.TotalClientErrors, epMetrics.TotalServerErrors, epMetrics.TotalTransportErrors)
+		}
+
+		if epMetrics.TotalConnectTimeouts > 0 || epMetrics.TotalResponseTimeouts > 0 {
+			fmt.Printf("    └── Timeouts: connect: %d | response: %d\n",
+				epMetrics.TotalConnectTimeouts, epMetrics.TotalResponseTimeouts)
+		}
+
+		if epMetrics.TotalTooManyRedirects > 0 {
+			fmt.Printf("    └── Too Many Redirects: %d (chains of up to %d redirects)\n",
+				epMetrics.TotalTooManyRedirects, epMetrics.MaxRedirectChain)
+		}
+
+		if len(epMetrics.RemoteIPCounts) > 0 {
+			fmt.Printf("    └── Remote IPs: %s\n", rg.formatShares(epMetrics.RemoteIPCounts))
+		}
+
+		if len(epMetrics.TLSVersionCounts) > 0 {
+			fmt.Printf("    └── TLS Versions: %s\n", rg.formatShares(epMetrics.TLSVersionCounts))
+			fmt.Printf("    └── TLS Cipher Suites: %s\n", rg.formatShares(epMetrics.TLSCipherSuiteCounts))
+		}
+
 		if epMetrics.TCPHandshakeLatencyTDigest != nil {
-			fmt.Printf("    └── TCP Handshake Latency: min=%v med=%v max=%v p(90)=%v p(95)=%v\n", tcpMin, tcpMed, tcpMax, tcpP90, tcpP95)
+			fmt.Printf("    └── TCP Handshake Latency: min=%v med=%v max=%v %s\n", tcpMin, tcpMed, tcpMax, rg.formatPercentiles(epMetrics, rg.quantileTCPHandshakeDuration))
 		}
 
 		if epMetrics.DNSLookupLatencyTDigest != nil {
-			fmt.Printf("    └── DNS Lookup Latency: min=%v med=%v max=%v p(90)=%v p(95)=%v\n", dnsMin, dnsMed, dnsMax, dnsP90, dnsP95)
+			fmt.Printf("    └── DNS Lookup Latency: min=%v med=%v max=%v %s\n", dnsMin, dnsMed, dnsMax, rg.formatPercentiles(epMetrics, rg.quantileDNSLookupDuration))
 		}
 
 		if epMetrics.TLSHandshakeLatencyTDigest != nil {
-			fmt.Printf("    └── TLS Handshake Latency: min=%v med=%v max=%v p(90)=%v p(95)=%v\n", tlsMin, tlsMed, tlsMax, tlsP90, tlsP95)
+			fmt.Printf("    └── TLS Handshake Latency: min=%v med=%v max=%v %s\n", tlsMin, tlsMed, tlsMax, rg.formatPercentiles(epMetrics, rg.quantileTLSHandshakeDuration))
+		}
+
+		if epMetrics.TTFBTDigest != nil {
+			fmt.Printf("    └── Time To First Byte: min=%v med=%v max=%v %s\n", ttfbMin, ttfbMed, ttfbMax, rg.formatPercentiles(epMetrics, rg.quantileTTFBDuration))
+		}
+
+		if epMetrics.BodyReceiveLatencyTDigest != nil {
+			fmt.Printf("    └── Content Download: min=%v med=%v max=%v %s\n", downloadMin, downloadMed, downloadMax, rg.formatPercentiles(epMetrics, rg.quantileBodyReceiveDuration))
 		}
 	}
 }
 
+// quantileBodyReceiveDuration calculates the content download time for a specific quantile.
+func (rg *ReportGenerator) quantileBodyReceiveDuration(epMetrics *metrics.EndpointMetricsAggregated, quantile float64) time.Duration {
+	if epMetrics.BodyReceiveLatencyTDigest != nil {
+		return time.Duration(epMetrics.BodyReceiveLatencyTDigest.Quantile(quantile)) * time.Millisecond
+	}
+	return 0
+}
+
+// quantileTTFBDuration calculates the time to first byte for a specific quantile.
+func (rg *ReportGenerator) quantileTTFBDuration(epMetrics *metrics.EndpointMetricsAggregated, quantile float64) time.Duration {
+	if epMetrics.TTFBTDigest != nil {
+		return time.Duration(epMetrics.TTFBTDigest.Quantile(quantile)) * time.Millisecond
+	}
+	return 0
+}
+
 func (rg *ReportGenerator) quantileTLSHandshakeDuration(epMetrics *metrics.EndpointMetricsAggregated, quantile float64) time.Duration {
 	if epMetrics.TLSHandshakeLatencyTDigest != nil {
 		return time.Duration(epMetrics.TLSHandshakeLatencyTDigest.Quantile(quantile)) * time.Millisecond
@@ -201,6 +347,16 @@ func (rg *ReportGenerator) quantileDuration(epMetrics *metrics.EndpointMetricsAg
 	return time.Duration(epMetrics.ResponseTimesTDigest.Quantile(quantile)) * time.Millisecond
 }
 
+// formatPercentiles formats the SummaryPercentiles of a latency, e.g.
+// "p(90)=12ms p(99)=40ms".
+func (rg *ReportGenerator) formatPercentiles(epMetrics *metrics.EndpointMetricsAggregated, quantile func(*metrics.EndpointMetricsAggregated, float64) time.Duration) string {
+	parts := make([]string, len(SummaryPercentiles))
+	for i, percentile := range SummaryPercentiles {
+		parts[i] = fmt.Sprintf("%s=%v", PercentileLabel(percentile), quantile(epMetrics, percentile/100))
+	}
+	return strings.Join(parts, " ")
+}
+
 // generateDots generates the dots for alignment in the report.
 func (rg *ReportGenerator) generateDots(endpoint string, totalLength int) string {
 	numDots := totalLength - len(endpoint)
@@ -216,3 +372,26 @@ func (rg *ReportGenerator) roundDurationToTwoDecimals(d time.Duration) time.Dura
 	roundedSeconds := math.Round(seconds*100) / 100
 	return time.Duration(roundedSeconds * float64(time.Second))
 }
+
+// formatShares lists counted values, e.g. the servers that answered an
+// endpoint, with their share of the total, most frequent first.
+func (rg *ReportGenerator) formatShares(counts map[string]int) string {
+	values := make([]string, 0, len(counts))
+	total := 0
+	for value, count := range counts {
+		values = append(values, value)
+		total += count
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("%s (%.2f%%)", value, rg.calculateRate(counts[value], total))
+	}
+	return strings.Join(parts, ", ")
+}
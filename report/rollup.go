@@ -0,0 +1,114 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/accelira/accelira/metrics"
+	"github.com/fatih/color"
+	"github.com/influxdata/tdigest"
+)
+
+// ByURL adds a section to the report that combines the requests to each URL
+// across all methods.
+var ByURL bool
+
+// urlRollup holds the combined metrics of one URL and its requests per method.
+type urlRollup struct {
+	combined *metrics.EndpointMetricsAggregated
+	methods  map[string]int
+}
+
+// splitEndpointKey splits an endpoint key such as "GET http://host/x" into its
+// method and URL. Keys without a method, such as the overflow bucket, are
+// returned whole as the URL.
+func splitEndpointKey(key string) (method, url string) {
+	method, url, ok := strings.Cut(key, " ")
+	if !ok || method == "" || strings.ToUpper(method) != method {
+		return "", key
+	}
+	return method, url
+}
+
+// rollUpByURL combines the HTTP request entries of metricsMap by URL.
+func rollUpByURL(metricsMap map[string]*metrics.EndpointMetricsAggregated) map[string]*urlRollup {
+	rollups := make(map[string]*urlRollup)
+	for key, epMetrics := range metricsMap {
+		if epMetrics.Type != metrics.HTTPRequest {
+			continue
+		}
+		method, url := splitEndpointKey(key)
+
+		rollup, ok := rollups[url]
+		if !ok {
+			rollup = &urlRollup{
+				combined: &metrics.EndpointMetricsAggregated{Type: metrics.HTTPRequest, ResponseTimesTDigest: tdigest.New()},
+				methods:  make(map[string]int),
+			}
+			rollups[url] = rollup
+		}
+		rollup.combined.TotalRequests += epMetrics.TotalRequests
+		rollup.combined.TotalErrors += epMetrics.TotalErrors
+		rollup.combined.TotalResponseTime += epMetrics.TotalResponseTime
+		if epMetrics.ResponseTimesTDigest != nil {
+			rollup.combined.ResponseTimesTDigest.AddCentroidList(epMetrics.ResponseTimesTDigest.Centroids())
+		}
+		if method != "" {
+			rollup.methods[method] += epMetrics.TotalRequests
+		}
+	}
+	return rollups
+}
+
+// printURLRollup prints the combined totals of every URL requested with more
+// than one method, next to its per-method request counts.
+func (rg *ReportGenerator) printURLRollup() {
+	rollups := rollUpByURL(*rg.metricsMap)
+	combined := make(map[string]*metrics.EndpointMetricsAggregated, len(rollups))
+	for url, rollup := range rollups {
+		if len(rollup.methods) > 1 {
+			combined[url] = rollup.combined
+		}
+	}
+	if len(combined) == 0 {
+		return
+	}
+
+	color.New(color.FgWhite, color.Bold).Println("\nURL Totals (all methods):")
+
+	all := func(*metrics.EndpointMetricsAggregated) bool { return true }
+	for _, url := range sortedKeys(combined, all) {
+		epMetrics := combined[url]
+		if epMetrics.TotalRequests == 0 {
+			continue
+		}
+		avg := rg.roundDurationToTwoDecimals(epMetrics.TotalResponseTime / time.Duration(epMetrics.TotalRequests))
+		fmt.Printf("  %s%s requests=%d errors=%d avg=%v med=%v max=%v %s\n",
+			url, rg.generateDots(url, 35), epMetrics.TotalRequests, epMetrics.TotalErrors, avg,
+			rg.quantileDuration(epMetrics, 0.5), rg.quantileDuration(epMetrics, 1), rg.formatPercentiles(epMetrics, rg.quantileDuration))
+		fmt.Printf("    └── Methods: %s\n", formatMethods(rollups[url].methods, epMetrics.TotalRequests))
+	}
+}
+
+// formatMethods lists methods with their request counts and share, busiest
+// first.
+func formatMethods(methods map[string]int, total int) string {
+	names := make([]string, 0, len(methods))
+	for method := range methods {
+		names = append(names, method)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if methods[names[i]] != methods[names[j]] {
+			return methods[names[i]] > methods[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	parts := make([]string, len(names))
+	for i, method := range names {
+		parts[i] = fmt.Sprintf("%s %d (%.2f%%)", method, methods[method], float64(methods[method])/float64(total)*100)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,57 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/accelira/accelira/metrics"
+)
+
+// SortBy orders the endpoints of the report: by name, or descending by p95
+// latency, requests or errors.
+var SortBy = "name"
+
+// sortValues returns the value endpoints are ordered by, descending, for each
+// sort order other than name.
+var sortValues = map[string]func(*metrics.EndpointMetricsAggregated) float64{
+	"p95": func(m *metrics.EndpointMetricsAggregated) float64 {
+		if m.ResponseTimesTDigest == nil {
+			return 0
+		}
+		return m.ResponseTimesTDigest.Quantile(0.95)
+	},
+	"requests": func(m *metrics.EndpointMetricsAggregated) float64 { return float64(m.TotalRequests) },
+	"errors":   func(m *metrics.EndpointMetricsAggregated) float64 { return float64(m.TotalErrors) },
+}
+
+// ParseSortOrder validates a sort order for SortBy.
+func ParseSortOrder(order string) (string, error) {
+	if _, ok := sortValues[order]; ok || order == "name" {
+		return order, nil
+	}
+	return "", fmt.Errorf("unknown sort order %q (available: name, p95, requests, errors)", order)
+}
+
+// sortedKeys returns the keys of the entries matching keep, ordered by SortBy.
+// Ties, and every entry when sorting by name, are ordered by key.
+func sortedKeys(metricsMap map[string]*metrics.EndpointMetricsAggregated, keep func(*metrics.EndpointMetricsAggregated) bool) []string {
+	keys := make([]string, 0, len(metricsMap))
+	for key, epMetrics := range metricsMap {
+		if keep(epMetrics) {
+			keys = append(keys, key)
+		}
+	}
+
+	value := sortValues[SortBy]
+	sort.Slice(keys, func(i, j int) bool {
+		if value != nil {
+			a, b := value(metricsMap[keys[i]]), value(metricsMap[keys[j]])
+			if a != b {
+				return a > b
+			}
+		}
+		return strings.Compare(keys[i], keys[j]) < 0
+	})
+	return keys
+}
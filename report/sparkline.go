@@ -0,0 +1,86 @@
+package report
+
+import (
+	"strings"
+
+	"github.com/accelira/accelira/metrics"
+)
+
+// sparkBlocks are the bar heights of a sparkline, lowest first.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// maxSparklineWidth caps the characters of a sparkline; longer series are
+// folded by merging neighbouring buckets.
+const maxSparklineWidth = 40
+
+// sparkline renders values as block characters scaled between their minimum,
+// or zero when zeroBased is set, and their maximum. A flat series is drawn at
+// the lowest height.
+func sparkline(values []float64, zeroBased bool) string {
+	if len(values) == 0 {
+		return ""
+	}
+	low, high := values[0], values[0]
+	if zeroBased {
+		low = 0
+	}
+	for _, value := range values {
+		if value < low {
+			low = value
+		}
+		if value > high {
+			high = value
+		}
+	}
+
+	var line strings.Builder
+	for _, value := range values {
+		level := 0
+		if high > low {
+			level = int((value - low) / (high - low) * float64(len(sparkBlocks)-1))
+		}
+		line.WriteRune(sparkBlocks[level])
+	}
+	return line.String()
+}
+
+// foldTimeSeries merges neighbouring buckets until at most maxSparklineWidth
+// remain.
+func foldTimeSeries(timeSeries []*metrics.EndpointBucket) []metrics.EndpointBucket {
+	size := (len(timeSeries) + maxSparklineWidth - 1) / maxSparklineWidth
+	folded := make([]metrics.EndpointBucket, 0, maxSparklineWidth)
+	for i := 0; i < len(timeSeries); i += size {
+		var bucket metrics.EndpointBucket
+		for _, part := range timeSeries[i:min(i+size, len(timeSeries))] {
+			bucket.Requests += part.Requests
+			bucket.Errors += part.Errors
+			bucket.TotalResponseTime += part.TotalResponseTime
+		}
+		folded = append(folded, bucket)
+	}
+	return folded
+}
+
+// formatTrend returns sparklines of an endpoint's mean latency and, when it
+// had any, its errors over the run, or "" with fewer than two buckets.
+func (rg *ReportGenerator) formatTrend(epMetrics *metrics.EndpointMetricsAggregated) string {
+	if len(epMetrics.TimeSeries) < 2 {
+		return ""
+	}
+
+	buckets := foldTimeSeries(epMetrics.TimeSeries)
+	latencies := make([]float64, len(buckets))
+	errors := make([]float64, len(buckets))
+	for i, bucket := range buckets {
+		if bucket.Requests > 0 {
+			latencies[i] = float64(bucket.TotalResponseTime) / float64(bucket.Requests)
+		}
+		errors[i] = float64(bucket.Errors)
+	}
+
+	trend := "latency " + sparkline(latencies, false)
+	if epMetrics.TotalErrors > 0 {
+		trend += " | errors " + sparkline(errors, true)
+	}
+	return trend
+}
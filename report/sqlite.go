@@ -0,0 +1,132 @@
+package report
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/accelira/accelira/metrics"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables of the sqlite output. Every run adds a row to
+// runs and one row per endpoint to endpoints, so history can be queried with
+// plain SQL, e.g. the p95 of an endpoint over time.
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS runs (
+  id INTEGER PRIMARY KEY,
+  finished_at TEXT NOT NULL,
+  tags TEXT,
+  requests INTEGER,
+  errors INTEGER
+);
+CREATE TABLE IF NOT EXISTS endpoints (
+  run_id INTEGER NOT NULL REFERENCES runs(id),
+  endpoint TEXT NOT NULL,
+  type TEXT NOT NULL,
+  requests INTEGER,
+  errors INTEGER,
+  avg_ms REAL,
+  min_ms REAL,
+  med_ms REAL,
+  max_ms REAL,
+  p90_ms REAL,
+  p95_ms REAL,
+  bytes_received INTEGER,
+  bytes_sent INTEGER
+);
+`
+
+// sqliteOutput appends the results of each run to a SQLite database, e.g.
+// sqlite=results.db, through a pure-Go driver so nothing has to be installed.
+// The database is opened and its tables created when the output is created,
+// so an unwritable file fails the run before any load is generated rather
+// than after it.
+type sqliteOutput struct {
+	path string
+	db   *sql.DB
+}
+
+func newSQLiteOutput(path string) (Output, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite output requires a file, e.g. sqlite=results.db")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables in %s: %w", path, err)
+	}
+	return sqliteOutput{path: path, db: db}, nil
+}
+
+func (o sqliteOutput) HandleSummary(metricsMap *map[string]*metrics.EndpointMetricsAggregated) error {
+	defer o.db.Close()
+
+	endpoints := make([]string, 0, len(*metricsMap))
+	for endpoint, epMetrics := range *metricsMap {
+		// Endpoints whose requests were all aborted have no response times
+		if (epMetrics.Type == metrics.HTTPRequest || epMetrics.Type == metrics.Group) && epMetrics.TotalRequests > 0 {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	sort.Strings(endpoints)
+
+	var requests, errors int
+	for _, endpoint := range endpoints {
+		if epMetrics := (*metricsMap)[endpoint]; epMetrics.Type == metrics.HTTPRequest {
+			requests += epMetrics.TotalRequests
+			errors += epMetrics.TotalErrors
+		}
+	}
+	var tags sql.NullString
+	if runTags := metrics.RunTags(); len(runTags) > 0 {
+		encoded, err := json.Marshal(runTags)
+		if err != nil {
+			return fmt.Errorf("error encoding run tags: %w", err)
+		}
+		tags = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	tx, err := o.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error writing to %s: %w", o.path, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO runs (finished_at, tags, requests, errors) VALUES (?, ?, ?, ?)",
+		time.Now().UTC().Format(time.RFC3339), tags, requests, errors)
+	if err != nil {
+		return fmt.Errorf("error writing run to %s: %w", o.path, err)
+	}
+	runID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("error writing run to %s: %w", o.path, err)
+	}
+
+	insertEndpoint, err := tx.Prepare("INSERT INTO endpoints VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("error writing endpoints to %s: %w", o.path, err)
+	}
+	defer insertEndpoint.Close()
+
+	for _, endpoint := range endpoints {
+		epMetrics := (*metricsMap)[endpoint]
+		avg := milliseconds(epMetrics.TotalResponseTime.Nanoseconds()) / float64(epMetrics.TotalRequests)
+		digest := epMetrics.ResponseTimesTDigest
+		if _, err := insertEndpoint.Exec(runID, endpoint, string(epMetrics.Type), epMetrics.TotalRequests, epMetrics.TotalErrors,
+			avg, digest.Quantile(0), digest.Quantile(0.5), digest.Quantile(1), digest.Quantile(0.9), digest.Quantile(0.95),
+			epMetrics.TotalBytesReceived, epMetrics.TotalBytesSent); err != nil {
+			return fmt.Errorf("error writing endpoint %s to %s: %w", endpoint, o.path, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error writing to %s: %w", o.path, err)
+	}
+	fmt.Printf("Results written to %s\n", o.path)
+	return nil
+}
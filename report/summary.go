@@ -0,0 +1,141 @@
+package report
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/accelira/accelira/metrics"
+)
+
+// jsonSummaryOutput writes a compact JSON summary of the run, meant for
+// machines, e.g. piping into jq.
+type jsonSummaryOutput struct {
+	writer io.Writer
+}
+
+// NewJSONSummaryOutput returns an output that writes the summary as a single
+// line of JSON to w.
+func NewJSONSummaryOutput(w io.Writer) Output {
+	return jsonSummaryOutput{writer: w}
+}
+
+// jsonSummary is the document written by jsonSummaryOutput. Durations are in
+// milliseconds.
+type jsonSummary struct {
+	Totals     jsonSummaryTotals              `json:"totals"`
+	Endpoints  map[string]jsonSummaryEndpoint `json:"endpoints"`
+	Checks     map[string]jsonSummaryCheck    `json:"checks"`
+	Tags       map[string]string              `json:"tags,omitempty"`              // tags given with --tag
+	SampleRate float64                        `json:"metricsSampleRate,omitempty"` // fraction of requests in the percentiles, if sampled
+}
+
+type jsonSummaryTotals struct {
+	Requests          int     `json:"requests"`
+	Iterations        int     `json:"iterations"`
+	DroppedIterations int     `json:"droppedIterations,omitempty"`
+	Errors            int     `json:"errors"`
+	ClientErrors      int     `json:"clientErrors"`
+	ServerErrors      int     `json:"serverErrors"`
+	TransportErrors   int     `json:"transportErrors"`
+	Aborted           int     `json:"aborted"`
+	BytesReceived     int     `json:"bytesReceived"`
+	BytesSent         int     `json:"bytesSent"`
+	AvgMs             float64 `json:"avgMs"`
+}
+
+type jsonSummaryEndpoint struct {
+	Type             metrics.MetricType `json:"type"`
+	Requests         int                `json:"requests"`
+	Errors           int                `json:"errors"`
+	ClientErrors     int                `json:"clientErrors,omitempty"`
+	ServerErrors     int                `json:"serverErrors,omitempty"`
+	TransportErrors  int                `json:"transportErrors,omitempty"`
+	ConnectTimeouts  int                `json:"connectTimeouts,omitempty"`
+	ResponseTimeouts int                `json:"responseTimeouts,omitempty"`
+	AvgMs            float64            `json:"avgMs"`
+	MinMs            float64            `json:"minMs"`
+	MedMs            float64            `json:"medMs"`
+	MaxMs            float64            `json:"maxMs"`
+	Percentiles      map[string]float64 `json:"percentiles"`
+	StatusCodes      map[int]int        `json:"statusCodes,omitempty"`
+}
+
+type jsonSummaryCheck struct {
+	Passes int `json:"passes"`
+	Fails  int `json:"fails"`
+}
+
+func (o jsonSummaryOutput) HandleSummary(metricsMap *map[string]*metrics.EndpointMetricsAggregated) error {
+	summary := jsonSummary{
+		Endpoints:  make(map[string]jsonSummaryEndpoint),
+		Checks:     make(map[string]jsonSummaryCheck),
+		Tags:       metrics.RunTags(),
+		SampleRate: MetricsSampleRate,
+	}
+
+	var totalResponseMs float64
+	for key, epMetrics := range *metricsMap {
+		switch epMetrics.Type {
+		case metrics.Error:
+			summary.Checks[key] = jsonSummaryCheck{Passes: epMetrics.TotalCheckPassed, Fails: epMetrics.TotalCheckFailed}
+			continue
+		case metrics.HTTPRequest:
+			summary.Totals.Requests += epMetrics.TotalRequests
+			summary.Totals.Errors += epMetrics.TotalErrors
+			summary.Totals.ClientErrors += epMetrics.TotalClientErrors
+			summary.Totals.ServerErrors += epMetrics.TotalServerErrors
+			summary.Totals.TransportErrors += epMetrics.TotalTransportErrors
+			summary.Totals.Aborted += epMetrics.TotalAborted
+			summary.Totals.BytesReceived += epMetrics.TotalBytesReceived
+			summary.Totals.BytesSent += epMetrics.TotalBytesSent
+			totalResponseMs += milliseconds(epMetrics.TotalResponseTime.Nanoseconds())
+		case metrics.Group:
+		case metrics.Iteration:
+			summary.Totals.Iterations += epMetrics.TotalRequests
+		case metrics.SchedulingDelay:
+		case metrics.DroppedIteration:
+			summary.Totals.DroppedIterations += epMetrics.TotalRequests
+			continue
+		default:
+			continue
+		}
+		// Endpoints whose requests were all aborted have no response times
+		if epMetrics.TotalRequests == 0 {
+			continue
+		}
+
+		endpoint := jsonSummaryEndpoint{
+			Type:             epMetrics.Type,
+			Requests:         epMetrics.TotalRequests,
+			Errors:           epMetrics.TotalErrors,
+			ClientErrors:     epMetrics.TotalClientErrors,
+			ServerErrors:     epMetrics.TotalServerErrors,
+			TransportErrors:  epMetrics.TotalTransportErrors,
+			ConnectTimeouts:  epMetrics.TotalConnectTimeouts,
+			ResponseTimeouts: epMetrics.TotalResponseTimeouts,
+			Percentiles:      make(map[string]float64, len(SummaryPercentiles)),
+			StatusCodes:      epMetrics.StatusCodeCounts,
+		}
+		if epMetrics.TotalRequests > 0 {
+			endpoint.AvgMs = milliseconds(epMetrics.TotalResponseTime.Nanoseconds()) / float64(epMetrics.TotalRequests)
+		}
+		if digest := epMetrics.ResponseTimesTDigest; digest != nil {
+			endpoint.MinMs = digest.Quantile(0)
+			endpoint.MedMs = digest.Quantile(0.5)
+			endpoint.MaxMs = digest.Quantile(1)
+			for _, percentile := range SummaryPercentiles {
+				endpoint.Percentiles[PercentileLabel(percentile)] = digest.Quantile(percentile / 100)
+			}
+		}
+		summary.Endpoints[key] = endpoint
+	}
+	if summary.Totals.Requests > 0 {
+		summary.Totals.AvgMs = totalResponseMs / float64(summary.Totals.Requests)
+	}
+
+	return json.NewEncoder(o.writer).Encode(summary)
+}
+
+func milliseconds(nanoseconds int64) float64 {
+	return float64(nanoseconds) / 1e6
+}
@@ -0,0 +1,49 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/accelira/accelira/metrics"
+)
+
+// OnlyTags restricts the console report to the endpoints and groups whose
+// requests have all of these tags. Checks are always shown.
+var OnlyTags map[string]string
+
+// ParseTags parses tags given as "key=value".
+func ParseTags(specs []string) (map[string]string, error) {
+	tags := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		name, value, ok := strings.Cut(spec, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected key=value", spec)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// formatTags formats tags as "key=value" pairs sorted by key.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for name, value := range tags {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// filterByTags returns the entries of metricsMap that have all of the given
+// tags, keeping checks.
+func filterByTags(metricsMap map[string]*metrics.EndpointMetricsAggregated, tags map[string]string) map[string]*metrics.EndpointMetricsAggregated {
+	filtered := make(map[string]*metrics.EndpointMetricsAggregated, len(metricsMap))
+	for key, epMetrics := range metricsMap {
+		if epMetrics.Type == metrics.Error || epMetrics.HasTags(tags) {
+			filtered[key] = epMetrics
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,141 @@
+package vmhandler
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/accelira/accelira/httpclient"
+	"github.com/accelira/accelira/metrics"
+	"github.com/accelira/accelira/moduleloader"
+)
+
+// dropRetryDelay is how long a VU without an arrival rate waits after a
+// dropped iteration before trying to start another.
+const dropRetryDelay = 10 * time.Millisecond
+
+// arrivalBacklog is how many scheduled iterations may wait for a free VU.
+// Beyond it they are dropped, so a pool far too small for the rate doesn't
+// queue without bound.
+const arrivalBacklog = 10000
+
+// droppedIterations counts iterations the arrival rate called for while the
+// backlog of iterations waiting for a VU was full.
+var droppedIterations int64
+
+// DroppedIterations returns the number of iterations dropped so far because
+// the backlog was full when the arrival rate scheduled them.
+func DroppedIterations() int64 {
+	return atomic.LoadInt64(&droppedIterations)
+}
+
+// dropAtConcurrencyLimit reports whether an iteration due to start now is
+// dropped because the concurrency limit is reached and the policy is "drop".
+// The drop is reported as a metric.
+func dropAtConcurrencyLimit(config *moduleloader.Config, metricsChan chan<- metrics.Metrics) bool {
+	if config.MaxConcurrentPolicy != "drop" || !httpclient.ConcurrencyLimitReached() {
+		return false
+	}
+	metrics.SendMetrics(metrics.CollectDroppedIterationMetrics(), metricsChan)
+	return true
+}
+
+// arrivalPacer starts iterations at a rate that ramps through the configured
+// stages, independently of how long iterations take. Every VU of a pool waits
+// on the same pacer; an iteration that finds no VU waiting is queued until one
+// is free. Each arrival carries the time it was scheduled for, so the VU
+// starting it can tell how late it is.
+type arrivalPacer struct {
+	stages   []moduleloader.RateStage
+	arrivals chan time.Time
+	start    sync.Once
+}
+
+func newArrivalPacer(stages []moduleloader.RateStage) *arrivalPacer {
+	return &arrivalPacer{stages: stages, arrivals: make(chan time.Time, arrivalBacklog)}
+}
+
+// waitUntil blocks until the next scheduled iteration, or takes the oldest
+// one still waiting for a VU, and returns the time it was scheduled for, reporting false when ctx is done or the deadline passes
+// first. The schedule starts with the first call.
+func (p *arrivalPacer) waitUntil(ctx context.Context, deadline time.Time) (time.Time, bool) {
+	p.start.Do(func() { go p.run(ctx, time.Now(), deadline) })
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case scheduled := <-p.arrivals:
+		return scheduled, true
+	case <-timer.C:
+		return time.Time{}, false
+	case <-ctx.Done():
+		return time.Time{}, false
+	}
+}
+
+// run hands out iterations at the rate of the stages until ctx is done or the
+// deadline passes. The nth arrival is scheduled for when the rate, integrated
+// from the start, reaches n, so a ramp from 0 starts slowly instead of
+// waiting out its first near-zero rate, and the rate doesn't drift when the
+// scheduler runs late.
+func (p *arrivalPacer) run(ctx context.Context, start, deadline time.Time) {
+	for n := 1; ; n++ {
+		offset, ok := p.arrivalOffset(float64(n))
+		next := start.Add(offset)
+		if !ok || next.After(deadline) {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		select {
+		case p.arrivals <- next:
+		default:
+			atomic.AddInt64(&droppedIterations, 1)
+		}
+	}
+}
+
+// arrivalOffset returns how far into the schedule the stages have called for
+// n iterations, reporting false if they never do. Each stage ramps linearly
+// from the previous stage's target, starting from 0; a stage without duration
+// jumps to its target. After the last stage its target is kept.
+func (p *arrivalPacer) arrivalOffset(n float64) (time.Duration, bool) {
+	offset, rate := 0.0, 0.0
+	for _, stage := range p.stages {
+		duration := stage.Duration.Seconds()
+		iterations := (rate + stage.Target) / 2 * duration
+		if n <= iterations {
+			return seconds(offset + rampTime(n, rate, (stage.Target-rate)/duration)), true
+		}
+		n -= iterations
+		offset += duration
+		rate = stage.Target
+	}
+	if rate <= 0 {
+		return 0, false
+	}
+	return seconds(offset + n/rate), true
+}
+
+// rampTime returns the seconds it takes for n iterations to start at a rate
+// that begins at rate and changes by slope per second.
+func rampTime(n, rate, slope float64) float64 {
+	if slope == 0 {
+		return n / rate
+	}
+	// Solve rate*t + slope/2*t² = n for the first t it holds
+	return (math.Sqrt(math.Max(rate*rate+2*slope*n, 0)) - rate) / slope
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -1,22 +1,30 @@
 package vmhandler
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/accelira/accelira/httpclient"
 	"github.com/accelira/accelira/metrics"
 	"github.com/accelira/accelira/moduleloader"
 	"github.com/dop251/goja"
 )
 
-func CreateConfigVM(content string) (*goja.Runtime, *moduleloader.Config, error) {
+func CreateConfigVM(content string, scriptDir string) (*goja.Runtime, *moduleloader.Config, error) {
 	vm := goja.New()
-	config := &moduleloader.Config{}
+	config := &moduleloader.Config{ScriptDir: scriptDir}
 	moduleloader.SetupConsoleModule(vm)
 	_ = moduleloader.InitializeModuleExport(vm)
 
 	vm.Set("require", moduleloader.SetupRequire(vm, config, nil))
+	vm.Set("__ENV", moduleloader.EnvironmentVariables(config))
 
 	_, err := vm.RunScript("config.js", string(content))
 	if err != nil {
@@ -26,36 +34,110 @@ func CreateConfigVM(content string) (*goja.Runtime, *moduleloader.Config, error)
 	return vm, config, nil
 }
 
-func ExecuteExportedFunction(vm *goja.Runtime, module *goja.Object) {
+// ApplyConfigScript runs a configuration file against config, so the load
+// profile can be kept apart from the scenario and reused with other scripts.
+func ApplyConfigScript(content string, config *moduleloader.Config) error {
+	vm := goja.New()
+	moduleloader.SetupConsoleModule(vm)
+	_ = moduleloader.InitializeModuleExport(vm)
+
+	vm.Set("require", moduleloader.SetupRequire(vm, config, nil))
+	vm.Set("__ENV", moduleloader.EnvironmentVariables(config))
+
+	if _, err := vm.RunScript("config-file.js", content); err != nil {
+		return fmt.Errorf("error running configuration file: %w", err)
+	}
+	return nil
+}
+
+// ExecuteExportedFunction runs the function exported under exec, or the
+// default export if exec is empty, passing it data.
+func ExecuteExportedFunction(vm *goja.Runtime, module *goja.Object, exec string, data goja.Value) {
+	if err := runExportedFunction(vm, module, exec, data); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// runExportedFunction is ExecuteExportedFunction returning the error instead
+// of printing it.
+func runExportedFunction(vm *goja.Runtime, module *goja.Object, exec string, data goja.Value) error {
 	moduleExports := module.Get("exports")
 
-	if fn, ok := goja.AssertFunction(moduleExports); ok {
+	if exec != "" {
+		fn, ok := goja.AssertFunction(moduleExports.ToObject(vm).Get(exec))
+		if !ok {
+			return fmt.Errorf("Export %q is not a function.", exec)
+		}
+		if err := executeFunctionWithErrorHandling(fn, data); err != nil {
+			return fmt.Errorf("Error executing export %q: %v", exec, err)
+		}
+	} else if fn, ok := goja.AssertFunction(moduleExports); ok {
 		// CommonJS style: module.exports = function() { ... }
-		if err := executeFunctionWithErrorHandling(vm, fn); err != nil {
-			fmt.Printf("Error executing CommonJS export function: %v\n", err)
+		if err := executeFunctionWithErrorHandling(fn, data); err != nil {
+			return fmt.Errorf("Error executing CommonJS export function: %v", err)
 		}
 	} else if defaultExport := moduleExports.ToObject(vm).Get("default"); defaultExport != nil {
 		if fn, ok := goja.AssertFunction(defaultExport); ok {
 			// ES6 style: export default function() { ... }
-			if err := executeFunctionWithErrorHandling(vm, fn); err != nil {
-				fmt.Printf("Error executing ES6 export function: %v\n", err)
+			if err := executeFunctionWithErrorHandling(fn, data); err != nil {
+				return fmt.Errorf("Error executing ES6 export function: %v", err)
 			}
 		} else {
-			fmt.Println("Default export is not a function.")
+			return fmt.Errorf("Default export is not a function.")
 		}
 	} else {
-		fmt.Println("No executable export found.")
+		return fmt.Errorf("No executable export found.")
 	}
+	return nil
 }
 
-func executeFunctionWithErrorHandling(vm *goja.Runtime, fn goja.Callable) error {
-	_, err := fn(goja.Undefined(), vm.ToValue(nil))
+func executeFunctionWithErrorHandling(fn goja.Callable, data goja.Value) error {
+	_, err := fn(goja.Undefined(), data)
 	if err != nil {
 		return fmt.Errorf("execution error: %w", err)
 	}
 	return nil
 }
 
+// RunHandleSummary calls the handleSummary(data) function exported by the
+// script, if any, with a snapshot of the aggregated results as data.metrics.
+// It returns the file name to content map the function returns, or nil if the
+// script does not export handleSummary.
+func RunHandleSummary(vm *goja.Runtime, metricsMap map[string]*metrics.EndpointMetricsAggregated) (map[string]string, error) {
+	module := vm.Get("module")
+	if module == nil {
+		return nil, nil
+	}
+	fn, ok := goja.AssertFunction(module.ToObject(vm).Get("exports").ToObject(vm).Get("handleSummary"))
+	if !ok {
+		return nil, nil
+	}
+
+	encoded, err := json.Marshal(metricsMap)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding results: %w", err)
+	}
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(encoded, &snapshot); err != nil {
+		return nil, fmt.Errorf("error encoding results: %w", err)
+	}
+
+	result, err := fn(goja.Undefined(), vm.ToValue(map[string]interface{}{"metrics": snapshot}))
+	if err != nil {
+		return nil, fmt.Errorf("handleSummary failed: %w", err)
+	}
+	if goja.IsUndefined(result) || goja.IsNull(result) {
+		return nil, nil
+	}
+
+	files := make(map[string]string)
+	resultObject := result.ToObject(vm)
+	for _, name := range resultObject.Keys() {
+		files[name] = resultObject.Get(name).String()
+	}
+	return files, nil
+}
+
 func ExecuteFunction(vm *goja.Runtime, fn goja.Callable) {
 	_, err := fn(goja.Undefined(), vm.ToValue(nil))
 	if err != nil {
@@ -63,22 +145,266 @@ func ExecuteFunction(vm *goja.Runtime, fn goja.Callable) {
 	}
 }
 
+// RequestLimitReached reports whether the configured maximum number of
+// requests has been issued.
+func RequestLimitReached(config *moduleloader.Config) bool {
+	return config.MaxRequests > 0 && httpclient.RequestsStarted() >= int64(config.MaxRequests)
+}
+
+var (
+	stopMutex  sync.Mutex
+	stopRun    context.CancelFunc
+	stopReason string
+)
+
+// SetStopFunc sets the function that cancels the run when a script calls
+// accelira.stop().
+func SetStopFunc(cancel context.CancelFunc) {
+	stopMutex.Lock()
+	defer stopMutex.Unlock()
+	stopRun = cancel
+}
+
+// StopTest ends the run early: all VUs wind down and the report is generated.
+// The first reason given is kept.
+func StopTest(reason string) {
+	stopMutex.Lock()
+	defer stopMutex.Unlock()
+	if stopReason == "" {
+		stopReason = reason
+	}
+	if stopRun != nil {
+		stopRun()
+	}
+}
+
+// StopReason returns the reason the script stopped the run with, or an empty
+// string if it ran to the end.
+func StopReason() string {
+	stopMutex.Lock()
+	defer stopMutex.Unlock()
+	return stopReason
+}
+
+// vuPanicCheck is the name under which VUs stopped by a panic are reported as
+// failed checks.
+const vuPanicCheck = "virtual user finished without panic"
+
+// recoverVU stops a panic in a VU from taking down the whole test. The VU ends,
+// the failure is logged and recorded, and the other VUs carry on.
+func recoverVU(metricsChan chan<- metrics.Metrics) {
+	if r := recover(); r != nil {
+		fmt.Printf("Virtual user stopped after a panic: %v\n", r)
+		metrics.SendMetrics(metrics.CollectErrorMetrics(vuPanicCheck, false), metricsChan)
+	}
+}
+
+// iterationTimeoutCheck is the name under which timed-out iterations are
+// reported as failed checks.
+const iterationTimeoutCheck = "iteration completed within timeout"
+
+// executeIteration runs one iteration of the script, updating __ELAPSED first.
+// With an iteration timeout configured, an iteration that runs too long is
+// interrupted and recorded as a failed check so the VU can move on.
+func executeIteration(vm *goja.Runtime, module *goja.Object, exec string, data goja.Value, config *moduleloader.Config, metricsChan chan<- metrics.Metrics) {
+	vm.Set("__ELAPSED", elapsedSeconds())
+	start := time.Now()
+	defer func() {
+		metrics.SendMetrics(metrics.CollectIterationMetrics(time.Since(start)), metricsChan)
+	}()
+
+	if config.IterationTimeout <= 0 {
+		ExecuteExportedFunction(vm, module, exec, data)
+		return
+	}
+
+	var mutex sync.Mutex
+	finished, timedOut := false, false
+	timer := time.AfterFunc(config.IterationTimeout, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !finished {
+			timedOut = true
+			vm.Interrupt(fmt.Sprintf("iteration exceeded timeout of %v", config.IterationTimeout))
+		}
+	})
+
+	ExecuteExportedFunction(vm, module, exec, data)
+
+	mutex.Lock()
+	finished = true
+	mutex.Unlock()
+	timer.Stop()
+
+	if timedOut {
+		vm.ClearInterrupt()
+		metrics.SendMetrics(metrics.CollectErrorMetrics(iterationTimeoutCheck, false), metricsChan)
+	}
+}
+
+// warmupPacing is the minimum time between iterations of a VU during warm-up.
+const warmupPacing = time.Second
+
+// waitForWarmupPacing waits for the next warm-up iteration, returning early
+// once the measured phase begins.
+func waitForWarmupPacing() {
+	deadline := time.Now().Add(warmupPacing)
+	for time.Now().Before(deadline) && !metrics.IsRecording() {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// compileScript compiles a script wrapped for running on a VU.
+func compileScript(script string) (*goja.Program, error) {
+	return goja.Compile("script.js", fmt.Sprintf("(function() { %s })();", script), false)
+}
+
 // VM pool structure
 type VMPool struct {
-	pool chan *goja.Runtime
+	pool    chan *goja.Runtime
+	program *goja.Program // the script every VM runs, compiled once for the pool
+	exec    string        // the export each iteration calls, empty for the default export
+
+	sharedIterations     bool  // iterations are drawn from sharedIterationsLeft
+	sharedIterationsLeft int64 // iterations not yet claimed by any VU
+
+	urlList   []moduleloader.URLTarget // requests of iterations when the script has no default export
+	arrivals  *arrivalPacer            // starts iterations at the configured rate stages, nil without stages
+	setupData string                   // JSON of the value returned by setup(), empty without setup
+
+	config      *moduleloader.Config // used to create replacement VMs
+	metricsChan chan<- metrics.Metrics
 }
 
 // Initialize a new VM pool
 func NewVMPool(size int, config *moduleloader.Config, metricsChan chan<- metrics.Metrics) (*VMPool, error) {
 	pool := make(chan *goja.Runtime, size)
 	for i := 0; i < size; i++ {
-		vm := goja.New()
-		moduleloader.SetupConsoleModule(vm)
-		moduleloader.InitializeModuleExport(vm)
-		vm.Set("require", moduleloader.SetupRequire(vm, config, metricsChan))
-		pool <- vm
+		pool <- newVM(config, metricsChan)
+	}
+	return &VMPool{pool: pool, config: config, metricsChan: metricsChan}, nil
+}
+
+// measuredStart holds the start of the measured phase in Unix nanoseconds, 0
+// until SetMeasuredStart is called.
+var measuredStart int64
+
+// SetMeasuredStart sets when the measured phase of the run starts, after any
+// warm-up. Scripts see the time since then as __ELAPSED.
+func SetMeasuredStart(start time.Time) {
+	atomic.StoreInt64(&measuredStart, start.UnixNano())
+}
+
+// elapsedSeconds returns the seconds since the measured phase started, 0
+// before it or when no start was set.
+func elapsedSeconds() float64 {
+	start := atomic.LoadInt64(&measuredStart)
+	if start == 0 {
+		return 0
+	}
+	return math.Max(0, time.Since(time.Unix(0, start)).Seconds())
+}
+
+// vmsCreated counts the VMs created for VUs, giving each a distinct seed.
+var vmsCreated int64
+
+// newVURandom returns the random source of a new VM. With a seed, VMs are
+// seeded with it plus their number, so runs are reproducible without every
+// VU drawing the same numbers.
+func newVURandom(seed int64) *rand.Rand {
+	n := atomic.AddInt64(&vmsCreated, 1)
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed + n))
+}
+
+// newVM creates a VM with the console, module exports and require set up.
+// The VM gets its own copy of the configuration: the script's config setters
+// run again on every VM and must not override the resolved configuration,
+// such as values from --config or command-line flags.
+func newVM(config *moduleloader.Config, metricsChan chan<- metrics.Metrics) *goja.Runtime {
+	vmConfig := *config
+	vm := goja.New()
+	random := newVURandom(config.Seed)
+	vm.SetRandSource(random.Float64)
+	moduleloader.SetupConsoleModule(vm)
+	moduleloader.SetupSleep(vm, random)
+	moduleloader.InitializeModuleExport(vm)
+	vm.Set("require", moduleloader.SetupRequire(vm, &vmConfig, metricsChan))
+	vm.Set("__ENV", moduleloader.EnvironmentVariables(config))
+	vm.Set("accelira", map[string]interface{}{
+		"stop": func(reason string) {
+			if reason == "" {
+				reason = "stopped by script"
+			}
+			StopTest(reason)
+		},
+		"requests": httpclient.RequestsStarted,
+	})
+	vm.Set("__ELAPSED", 0)
+	vm.Set("__VU", 0)
+	return vm
+}
+
+// NewVMPoolWithScript creates a VM pool that runs the given script. The script
+// is compiled once here and the program is shared by every VM, so adding VUs
+// does not parse the bundle again. Iterations call the export named by
+// config.Exec as it is now, so VUs re-running the script can't change it.
+func NewVMPoolWithScript(size int, script string, config *moduleloader.Config, metricsChan chan<- metrics.Metrics) (*VMPool, error) {
+	program, err := compileScript(script)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling script: %w", err)
+	}
+
+	pool, err := NewVMPool(size, config, metricsChan)
+	if err != nil {
+		return nil, err
 	}
-	return &VMPool{pool: pool}, nil
+	pool.program = program
+	pool.exec = config.Exec
+	pool.urlList = config.URLList
+	httpclient.SetMaxConcurrent(config.MaxConcurrent)
+	if len(config.RateStages) > 0 {
+		pool.arrivals = newArrivalPacer(config.RateStages)
+	}
+	if config.SharedIterations > 0 {
+		pool.sharedIterations = true
+		pool.sharedIterationsLeft = int64(config.SharedIterations)
+	}
+	return pool, nil
+}
+
+// claimIteration takes one of the pool's shared iterations, reporting false
+// once all have been claimed. Without shared iterations it always succeeds.
+func (p *VMPool) claimIteration() bool {
+	if !p.sharedIterations {
+		return true
+	}
+	// The count never goes below zero, so a released iteration can be
+	// claimed again.
+	for {
+		left := atomic.LoadInt64(&p.sharedIterationsLeft)
+		if left <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&p.sharedIterationsLeft, left, left-1) {
+			return true
+		}
+	}
+}
+
+// releaseIteration returns a claimed shared iteration that didn't run, e.g.
+// because it was dropped at the concurrency limit.
+func (p *VMPool) releaseIteration() {
+	if p.sharedIterations {
+		atomic.AddInt64(&p.sharedIterationsLeft, 1)
+	}
+}
+
+// SharedIterationsDone reports whether all shared iterations have been claimed.
+func (p *VMPool) SharedIterationsDone() bool {
+	return p.sharedIterations && atomic.LoadInt64(&p.sharedIterationsLeft) <= 0
 }
 
 // Get a VM from the pool
@@ -112,24 +438,311 @@ func (p *VMPool) Put(vm *goja.Runtime) {
 
 // }
 
-func RunScriptWithPool(script string, metricsChan chan<- metrics.Metrics, wg *sync.WaitGroup, config *moduleloader.Config, vmPool *VMPool) {
-	defer wg.Done()
+// startVM runs the pool's script on a VM and returns its module. Until stop is
+// called, cancelling ctx interrupts the VM.
+func startVM(ctx context.Context, vm *goja.Runtime, vmPool *VMPool) (module *goja.Object, stop func() bool, err error) {
+	stop = context.AfterFunc(ctx, func() { vm.Interrupt("test stopped") })
+
+	module = moduleloader.InitializeModuleExport(vm)
+	if _, err := vm.RunProgram(vmPool.program); err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	if vmPool.exec != "" {
+		if _, ok := goja.AssertFunction(module.Get("exports").ToObject(vm).Get(vmPool.exec)); !ok {
+			stop()
+			return nil, nil, fmt.Errorf("export %q is not a function", vmPool.exec)
+		}
+	} else if len(vmPool.urlList) > 0 && !hasDefaultExport(vm, module) {
+		// Without a default export, iterations request the URL list
+		iteration, err := urlListIteration(vm, vmPool.urlList)
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		module.Get("exports").ToObject(vm).Set("default", iteration)
+	}
+	return module, stop, nil
+}
+
+// warmupExport is the export run instead of the iteration function before the
+// measured phase, if the script has one, e.g. to prime caches.
+const warmupExport = "warmup"
+
+// hasExportedFunction reports whether the module exports a function by name.
+func hasExportedFunction(vm *goja.Runtime, module *goja.Object, name string) bool {
+	_, ok := goja.AssertFunction(module.Get("exports").ToObject(vm).Get(name))
+	return ok
+}
+
+// setupExport is the export run once before any VU starts. Every iteration
+// receives a copy of what it returns.
+const setupExport = "setup"
+
+// RunSetup runs the script's setup export once on one of the pool's VMs,
+// discarding its metrics, and keeps its return value as JSON for the VUs. It
+// reports false without running anything if the script has no such export.
+func RunSetup(ctx context.Context, vmPool *VMPool) (bool, error) {
+	var data string
+	ran, err := runOnce(ctx, vmPool, setupExport, func(vm *goja.Runtime, result goja.Value) error {
+		stringify, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("stringify"))
+		encoded, err := stringify(goja.Undefined(), result)
+		if err != nil {
+			return fmt.Errorf("the value returned by setup() can't be passed to VUs: %v", err)
+		}
+		if !goja.IsUndefined(encoded) {
+			data = encoded.String()
+		}
+		return nil
+	})
+	if err != nil {
+		return ran, err
+	}
+	vmPool.setupData = data
+	return ran, nil
+}
+
+// RunWarmup runs the script's warmup export once on one of the pool's VMs,
+// discarding its metrics, so it can prime the target before any VU starts. It
+// reports false without running anything if the script has no such export.
+func RunWarmup(ctx context.Context, vmPool *VMPool) (bool, error) {
+	return runOnce(ctx, vmPool, warmupExport, nil)
+}
+
+// runOnce runs an export of the script once on one of the pool's VMs with
+// metrics discarded, passing its result to handle if set. It reports false
+// without running anything if the script doesn't have the export.
+func runOnce(ctx context.Context, vmPool *VMPool, export string, handle func(*goja.Runtime, goja.Value) error) (bool, error) {
+	vm := vmPool.Get()
+	defer vmPool.Put(vm)
+
+	module, stopInterrupt, err := startVM(ctx, vm, vmPool)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		stopInterrupt()
+		vm.ClearInterrupt()
+	}()
+
+	fn, ok := goja.AssertFunction(module.Get("exports").ToObject(vm).Get(export))
+	if !ok {
+		return false, nil
+	}
+	metrics.PauseRecording()
+	defer metrics.ResumeRecording()
+	result, err := fn(goja.Undefined(), vmPool.setupValue(vm))
+	if err != nil {
+		return true, fmt.Errorf("Error executing export %q: %v", export, err)
+	}
+	if handle != nil {
+		return true, handle(vm, result)
+	}
+	return true, nil
+}
+
+// setupValue decodes the setup data for a VM, so every VU gets a copy of its
+// own. It is null if the script has no setup export.
+func (p *VMPool) setupValue(vm *goja.Runtime) goja.Value {
+	if p.setupData == "" {
+		return goja.Null()
+	}
+	parse, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("parse"))
+	value, err := parse(goja.Undefined(), vm.ToValue(p.setupData))
+	if err != nil {
+		return goja.Null()
+	}
+	return value
+}
+
+// hasDefaultExport reports whether the module exports a function to run on
+// every iteration, ES6 or CommonJS style.
+func hasDefaultExport(vm *goja.Runtime, module *goja.Object) bool {
+	exports := module.Get("exports")
+	if _, ok := goja.AssertFunction(exports); ok {
+		return true
+	}
+	_, ok := goja.AssertFunction(exports.ToObject(vm).Get("default"))
+	return ok
+}
+
+// urlListIteration returns an iteration that sends one request of the URL
+// list, picked by weight, through the VM's http module so hooks and client
+// options apply as they would to a script's requests.
+func urlListIteration(vm *goja.Runtime, targets []moduleloader.URLTarget) (func(), error) {
+	require, ok := goja.AssertFunction(vm.Get("require"))
+	if !ok {
+		return nil, fmt.Errorf("require is not set up")
+	}
+	httpModule, err := require(goja.Undefined(), vm.ToValue("Accelira/http"))
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]goja.Callable, len(targets))
+	totalWeight := 0.0
+	for i, target := range targets {
+		request, ok := goja.AssertFunction(httpModule.ToObject(vm).Get(strings.ToLower(target.Method)))
+		if !ok {
+			return nil, fmt.Errorf("unsupported method %q in the URL list", target.Method)
+		}
+		requests[i] = request
+		totalWeight += target.Weight
+	}
+	if totalWeight <= 0 {
+		return nil, fmt.Errorf("the URL list has no entry with a positive weight")
+	}
+	// Picks draw from the VM's random source, seeded per VU, so setSeed makes
+	// them reproducible
+	random, ok := goja.AssertFunction(vm.Get("Math").ToObject(vm).Get("random"))
+	if !ok {
+		return nil, fmt.Errorf("Math.random is not a function")
+	}
+
+	return func() {
+		value, err := random(goja.Undefined())
+		if err != nil {
+			panic(err)
+		}
+		pick := value.ToFloat() * totalWeight
+		chosen := len(targets) - 1
+		for i, target := range targets {
+			if pick < target.Weight {
+				chosen = i
+				break
+			}
+			pick -= target.Weight
+		}
+		if _, err := requests[chosen](goja.Undefined(), vm.ToValue(targets[chosen].URL)); err != nil {
+			panic(err)
+		}
+	}, nil
+}
+
+// RunIteration runs a single iteration of the script on a fresh VM, e.g. to
+// check a script before a load test, returning the error it failed with.
+func RunIteration(ctx context.Context, script string, config *moduleloader.Config, metricsChan chan<- metrics.Metrics) error {
+	vmPool, err := NewVMPoolWithScript(1, script, config, metricsChan)
+	if err != nil {
+		return err
+	}
+	if _, err := RunSetup(ctx, vmPool); err != nil {
+		return err
+	}
 
 	vm := vmPool.Get()
 	defer vmPool.Put(vm)
 
-	module := moduleloader.InitializeModuleExport(vm)
-	_, err := vm.RunScript("script.js", fmt.Sprintf("(function() { %s })();", script))
+	module, stopInterrupt, err := startVM(ctx, vm, vmPool)
+	if err != nil {
+		return err
+	}
+	defer stopInterrupt()
+
+	return runExportedFunction(vm, module, vmPool.exec, vmPool.setupValue(vm))
+}
+
+// vusStarted counts the VUs started, numbering them from 1 for __VU.
+var vusStarted int64
+
+// RunScriptWithPool runs the pool's script on a pooled VM until the configured
+// duration elapses. Cancelling ctx interrupts the running iteration.
+func RunScriptWithPool(ctx context.Context, metricsChan chan<- metrics.Metrics, wg *sync.WaitGroup, config *moduleloader.Config, vmPool *VMPool) {
+	defer wg.Done()
+	defer recoverVU(metricsChan)
+
+	vm := vmPool.Get()
+	defer func() { vmPool.Put(vm) }()
+
+	if vmPool.program == nil {
+		fmt.Println("Error running script: the VM pool has no script")
+		return
+	}
+
+	vu := atomic.AddInt64(&vusStarted, 1)
+	vm.Set("__VU", vu)
+	module, stopInterrupt, err := startVM(ctx, vm, vmPool)
 	if err != nil {
 		fmt.Println("Error running script:", err)
 		return
 	}
+	defer func() {
+		stopInterrupt()
+		vm.ClearInterrupt()
+	}()
+	data := vmPool.setupValue(vm)
+
+	// Warm up connections at a low rate until the measured phase starts,
+	// running the script's warmup export instead of iterations if it has one
+	warmupExec := vmPool.exec
+	if hasExportedFunction(vm, module, warmupExport) {
+		warmupExec = warmupExport
+	}
+	for !metrics.IsRecording() && ctx.Err() == nil && !RequestLimitReached(config) {
+		executeIteration(vm, module, warmupExec, data, config, metricsChan)
+		waitForWarmupPacing()
+	}
 
 	// Duration for which the script should run
 	duration := config.Duration
 	endTime := time.Now().Add(duration)
 
-	for time.Now().Before(endTime) {
-		ExecuteExportedFunction(vm, module)
+	// Pace iterations so a VU never exceeds its rate, even if responses are
+	// instant. The wait happens between iterations, outside any request timing.
+	var pacer *time.Ticker
+	if config.VURate > 0 {
+		pacer = time.NewTicker(time.Duration(float64(time.Second) / config.VURate))
+		defer pacer.Stop()
+	}
+
+	iterationsOnVM := 0
+	for time.Now().Before(endTime) && ctx.Err() == nil && !RequestLimitReached(config) && vmPool.claimIteration() {
+		// With rate stages, iterations start when the schedule says so
+		var scheduled time.Time
+		if vmPool.arrivals != nil {
+			var ok bool
+			if scheduled, ok = vmPool.arrivals.waitUntil(ctx, endTime); !ok {
+				break
+			}
+		}
+		if dropAtConcurrencyLimit(config, metricsChan) {
+			vmPool.releaseIteration()
+			// Without an arrival rate, wait a moment rather than spin
+			if vmPool.arrivals == nil {
+				time.Sleep(dropRetryDelay)
+			}
+			continue
+		}
+
+		// Replace the VM after MaxIterationsPerVM iterations so JS heap
+		// state can't grow for the whole test.
+		if config.MaxIterationsPerVM > 0 && iterationsOnVM == config.MaxIterationsPerVM {
+			stopInterrupt()
+			vm = newVM(vmPool.config, vmPool.metricsChan)
+			vm.Set("__VU", vu)
+			module, stopInterrupt, err = startVM(ctx, vm, vmPool)
+			if err != nil {
+				fmt.Println("Error running script:", err)
+				return
+			}
+			data = vmPool.setupValue(vm)
+			iterationsOnVM = 0
+		}
+
+		// How late the iteration starts against the schedule, including the
+		// time it waited for a free VU and to replace the VM
+		if !scheduled.IsZero() {
+			metrics.SendMetrics(metrics.CollectSchedulingDelayMetrics(time.Since(scheduled)), metricsChan)
+		}
+		executeIteration(vm, module, vmPool.exec, data, config, metricsChan)
+		iterationsOnVM++
+
+		if pacer != nil {
+			select {
+			case <-pacer.C:
+			case <-ctx.Done():
+			}
+		}
 	}
 }
@@ -1,7 +1,12 @@
 package vmhandler
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/accelira/accelira/metrics"
 	"github.com/accelira/accelira/moduleloader"
@@ -48,3 +53,192 @@ func TestHandlingZeroSizeVMPool(t *testing.T) {
 		t.Fatalf("expected pool size %d, got %d", size, len(pool.pool))
 	}
 }
+
+// Requiring a local module at runtime resolves it relative to the script directory
+func TestRequireLocalModule(t *testing.T) {
+	dir := t.TempDir()
+	helper := "module.exports = { users: function() { return require('./count') * 2; } };"
+	if err := os.WriteFile(filepath.Join(dir, "helpers.js"), []byte(helper), 0o644); err != nil {
+		t.Fatalf("failed to write helper: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "count.js"), []byte("module.exports = 3;"), 0o644); err != nil {
+		t.Fatalf("failed to write count: %v", err)
+	}
+
+	script := `
+		const config = require('Accelira/config');
+		const name = './helpers.js';
+		config.setConcurrentUsers(require(name).users());
+	`
+	_, config, err := CreateConfigVM(script, dir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if config.ConcurrentUsers != 6 {
+		t.Fatalf("expected 6 concurrent users, got %d", config.ConcurrentUsers)
+	}
+}
+
+// Requiring a missing local module throws instead of returning undefined
+func TestRequireMissingLocalModule(t *testing.T) {
+	_, _, err := CreateConfigVM("require('./missing.js');", t.TempDir())
+	if err == nil {
+		t.Fatalf("expected an error for a missing module")
+	}
+}
+
+// Repeated checks share one key and a throwing assertion counts as a failure
+func TestCheckAggregatesByNameAndCatchesExceptions(t *testing.T) {
+	metricsChan := make(chan metrics.Metrics, 10)
+	pool, err := NewVMPool(1, &moduleloader.Config{}, metricsChan)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	vm := pool.Get()
+
+	script := `
+		const assert = require('Accelira/assert');
+		const res = { response: { StatusCode: 200 } };
+		for (let i = 0; i < 3; i++) {
+			assert.check(res, {
+				'status is 200': (r) => r.StatusCode === 200,
+				'throws': (r) => { throw new Error('boom'); },
+			});
+		}
+	`
+	if _, err := vm.RunString(script); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	close(metricsChan)
+
+	results := map[string][]bool{}
+	for m := range metricsChan {
+		for key, ep := range m.EndpointMetricsMap {
+			results[key] = append(results[key], ep.CheckResult)
+		}
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("expected 2 check keys, got %d", len(results))
+	}
+	for _, passed := range results["status is 200"] {
+		if !passed {
+			t.Fatalf("expected 'status is 200' to pass")
+		}
+	}
+	if len(results["throws"]) != 3 {
+		t.Fatalf("expected 3 results for 'throws', got %d", len(results["throws"]))
+	}
+	for _, passed := range results["throws"] {
+		if passed {
+			t.Fatalf("expected 'throws' to fail")
+		}
+	}
+}
+
+// handleSummary receives the aggregated results and returns files to write
+func TestRunHandleSummary(t *testing.T) {
+	script := `
+		module.exports.handleSummary = function (data) {
+			return { 'summary.txt': 'requests=' + data.metrics['GET /'].TotalRequests };
+		};
+	`
+	vm, _, err := CreateConfigVM(script, t.TempDir())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	metricsMap := map[string]*metrics.EndpointMetricsAggregated{
+		"GET /": {TotalRequests: 7},
+	}
+	files, err := RunHandleSummary(vm, metricsMap)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if files["summary.txt"] != "requests=7" {
+		t.Fatalf("expected requests=7, got %q", files["summary.txt"])
+	}
+}
+
+// A shared iteration dropped after being claimed is released and still runs,
+// even if another VU failed to claim one in the meantime
+func TestReleasedSharedIterationIsClaimedAgain(t *testing.T) {
+	pool, err := NewVMPoolWithScript(0, "", &moduleloader.Config{SharedIterations: 1}, make(chan metrics.Metrics))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if !pool.claimIteration() {
+		t.Fatal("expected the shared iteration to be claimed")
+	}
+	if pool.claimIteration() {
+		t.Fatal("expected no second shared iteration")
+	}
+	pool.releaseIteration()
+	if !pool.claimIteration() {
+		t.Fatal("expected the released iteration to be claimed again")
+	}
+	if !pool.SharedIterationsDone() {
+		t.Fatal("expected all shared iterations to be claimed")
+	}
+}
+
+// A stage ramping up from 0 starts the iterations its rate adds up to, rather
+// than waiting out the near-zero rate it starts with
+func TestArrivalsOfRampingStage(t *testing.T) {
+	pacer := newArrivalPacer([]moduleloader.RateStage{{Duration: time.Second, Target: 100}})
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		pacer.run(context.Background(), start, start.Add(time.Second))
+		close(done)
+	}()
+
+	arrivals := 0
+	for {
+		select {
+		case <-pacer.arrivals:
+			arrivals++
+			continue
+		case <-done:
+		}
+		break
+	}
+
+	// 0 to 100/s over a second calls for 50 iterations
+	if arrivals < 45 || arrivals > 50 {
+		t.Fatalf("expected about 50 arrivals, got %d", arrivals)
+	}
+}
+
+// With fewer VUs than the arrival rate needs, scheduled iterations wait for a
+// free VU and the wait shows as scheduling delay
+func TestArrivalsWaitForBusyVU(t *testing.T) {
+	config := &moduleloader.Config{
+		ConcurrentUsers: 1,
+		Duration:        300 * time.Millisecond,
+		RateStages:      []moduleloader.RateStage{{Target: 100}},
+	}
+	script := `module.exports = function () { const start = Date.now(); while (Date.now() - start < 30) {} };`
+	metricsChan := make(chan metrics.Metrics, 1000)
+	pool, err := NewVMPoolWithScript(1, script, config, metricsChan)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	RunScriptWithPool(context.Background(), metricsChan, &waitGroup, config, pool)
+	close(metricsChan)
+
+	var maxDelay time.Duration
+	for m := range metricsChan {
+		if delay, ok := m.EndpointMetricsMap[metrics.SchedulingDelayKey]; ok && delay.ResponseTime > maxDelay {
+			maxDelay = delay.ResponseTime
+		}
+	}
+	if maxDelay < 50*time.Millisecond {
+		t.Fatalf("expected iterations to wait for the busy VU, got a max delay of %v", maxDelay)
+	}
+}